@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/pkg/dns"
+	"github.com/betterde/cdns/pkg/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	record "github.com/miekg/dns"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// acme-dns keeps the two most recent TXT records so that wildcard and apex certificates can be validated together
+const acmeDNSRecordsPerSubdomain = 2
+
+var acmeDNSTxtPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+type RegisterRequest struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type RegisterResponse struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Subdomain  string   `json:"subdomain"`
+	FullDomain string   `json:"fulldomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type UpdateRequest struct {
+	TXT       string `json:"txt"`
+	Subdomain string `json:"subdomain"`
+}
+
+// Register create an acme-dns compatible account
+func Register(ctx *fiber.Ctx) error {
+	payload := RegisterRequest{}
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&payload); err != nil {
+			return acmeDNSError(ctx, fiber.StatusBadRequest, "malformed_json_payload")
+		}
+	}
+
+	for _, cidr := range payload.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return acmeDNSError(ctx, fiber.StatusBadRequest, "invalid_allowfrom_cidr")
+		}
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return acmeDNSError(ctx, fiber.StatusInternalServerError, "failed_to_create_user")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return acmeDNSError(ctx, fiber.StatusInternalServerError, "failed_to_create_user")
+	}
+
+	account := store.Account{
+		Username:  uuid.NewString(),
+		Password:  string(hash),
+		Subdomain: uuid.NewString(),
+		AllowFrom: payload.AllowFrom,
+	}
+
+	if account.AllowFrom == nil {
+		account.AllowFrom = []string{}
+	}
+
+	if err = dns.Store.SaveAccount(account); err != nil {
+		journal.Logger.Sugar().With("Error", err.Error()).Error("Failed to save acme-dns account")
+		return acmeDNSError(ctx, fiber.StatusInternalServerError, "failed_to_create_user")
+	}
+
+	return ctx.Status(fiber.StatusCreated).JSON(RegisterResponse{
+		Username:   account.Username,
+		Password:   password,
+		Subdomain:  account.Subdomain,
+		FullDomain: acmeDNSFullDomain(account.Subdomain),
+		AllowFrom:  account.AllowFrom,
+	})
+}
+
+// Update replace the oldest TXT record of an acme-dns account subdomain
+func Update(ctx *fiber.Ctx) error {
+	account, err := dns.Store.Account(ctx.Get("X-Api-User"))
+	if err != nil {
+		journal.Logger.Sugar().With("Error", err.Error()).Error("Failed to load acme-dns account")
+		return acmeDNSError(ctx, fiber.StatusInternalServerError, "db_error")
+	}
+
+	if account == nil || bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(ctx.Get("X-Api-Key"))) != nil {
+		return acmeDNSError(ctx, fiber.StatusUnauthorized, "forbidden")
+	}
+
+	if !allowedFrom(account.AllowFrom, ctx.IP()) {
+		return acmeDNSError(ctx, fiber.StatusUnauthorized, "forbidden")
+	}
+
+	payload := UpdateRequest{}
+	if err = ctx.BodyParser(&payload); err != nil {
+		return acmeDNSError(ctx, fiber.StatusBadRequest, "malformed_json_payload")
+	}
+
+	if !strings.EqualFold(payload.Subdomain, account.Subdomain) {
+		return acmeDNSError(ctx, fiber.StatusUnauthorized, "forbidden")
+	}
+
+	if !acmeDNSTxtPattern.MatchString(payload.TXT) {
+		return acmeDNSError(ctx, fiber.StatusBadRequest, "bad_txt")
+	}
+
+	name := acmeDNSFullDomain(account.Subdomain)
+	txtRecord := &record.TXT{
+		Hdr: record.RR_Header{
+			Name:   name,
+			Rrtype: record.TypeTXT,
+			Class:  record.ClassINET,
+			Ttl:    1,
+		},
+		Txt: []string{payload.TXT},
+	}
+
+	if err = dns.RotateTXTRecord(txtRecord, acmeDNSRecordsPerSubdomain); err != nil {
+		journal.Logger.Sugar().With("FQDN", name, "Error", err.Error()).Error("Failed to update TXT record")
+		return acmeDNSError(ctx, fiber.StatusInternalServerError, "db_error")
+	}
+
+	return ctx.JSON(fiber.Map{"txt": payload.TXT})
+}
+
+// acmeDNSError responds in the format expected by acme-dns clients
+func acmeDNSError(ctx *fiber.Ctx, code int, message string) error {
+	return ctx.Status(code).JSON(fiber.Map{"error": message})
+}
+
+func acmeDNSFullDomain(subdomain string) string {
+	return strings.ToLower(subdomain + "." + strings.TrimSuffix(config.Get().HTTP.Domain, "."))
+}
+
+func allowedFrom(cidrs []string, addr string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func randomPassword() (string, error) {
+	buf := make([]byte, 30)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/internal/response"
+	"github.com/betterde/cdns/pkg/dns"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reload re-read the configuration and rebuild the static records
+func Reload(ctx *fiber.Ctx) error {
+	if err := dns.Reload(); err != nil {
+		journal.Logger.Sugar().With("Error", err.Error()).Error("Failed to reload configuration")
+		return ctx.Status(fiber.StatusInternalServerError).JSON(response.InternalServerError("Failed to reload configuration.", err))
+	}
+
+	return ctx.JSON(response.Success("Success", nil))
+}
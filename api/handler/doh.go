@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/betterde/cdns/internal/response"
+	"github.com/betterde/cdns/pkg/dns"
+	"github.com/gofiber/fiber/v2"
+	record "github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+const (
+	// dnsMessage is the media type of DNS wire format messages (RFC 8484)
+	dnsMessage = "application/dns-message"
+	// dnsJSON is the media type of the JSON flavor used by Google and Cloudflare
+	dnsJSON = "application/dns-json"
+)
+
+// JSONMessage is a response of the DNS-over-HTTPS JSON API
+type JSONMessage struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []JSONQuestion `json:"Question"`
+	Answer     []JSONRecord   `json:"Answer,omitempty"`
+	Authority  []JSONRecord   `json:"Authority,omitempty"`
+	Additional []JSONRecord   `json:"Additional,omitempty"`
+}
+
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// Query answers a DNS-over-HTTPS GET request, with the base64url encoded message in the dns parameter (RFC 8484)
+// or with the name and type parameters of the JSON API
+func Query(ctx *fiber.Ctx) error {
+	if ctx.Query("dns") == "" && ctx.Query("name") != "" {
+		return queryJSON(ctx)
+	}
+
+	wire, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(ctx.Query("dns"), "="))
+	if err != nil || len(wire) == 0 {
+		return ctx.Status(fiber.StatusBadRequest).JSON(response.Send(fiber.StatusBadRequest, "The dns parameter is not a base64url encoded DNS message.", nil))
+	}
+
+	return exchange(ctx, wire)
+}
+
+// QueryMessage answers a DNS-over-HTTPS POST request with a DNS message in the body (RFC 8484)
+func QueryMessage(ctx *fiber.Ctx) error {
+	if !strings.HasPrefix(ctx.Get(fiber.HeaderContentType), dnsMessage) {
+		return ctx.Status(fiber.StatusUnsupportedMediaType).JSON(response.Send(fiber.StatusUnsupportedMediaType, "The content type must be "+dnsMessage+".", nil))
+	}
+
+	return exchange(ctx, ctx.Body())
+}
+
+// exchange answers a DNS message in wire format
+func exchange(ctx *fiber.Ctx, wire []byte) error {
+	r := new(record.Msg)
+	if err := r.Unpack(wire); err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(response.Send(fiber.StatusBadRequest, "Malformed DNS message.", nil))
+	}
+
+	m := dns.Exchange(ctx.Context().RemoteAddr(), r)
+	packed, err := m.Pack()
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(response.InternalServerError("Unable to pack DNS message.", err))
+	}
+
+	setCacheControl(ctx, m)
+	ctx.Set(fiber.HeaderContentType, dnsMessage)
+
+	return ctx.Send(packed)
+}
+
+// queryJSON answers a request of the JSON API
+func queryJSON(ctx *fiber.Ctx) error {
+	qtype := record.TypeA
+	if value := ctx.Query("type"); value != "" {
+		if number, err := strconv.ParseUint(value, 10, 16); err == nil {
+			qtype = uint16(number)
+		} else if known, ok := record.StringToType[strings.ToUpper(value)]; ok {
+			qtype = known
+		} else {
+			return ctx.Status(fiber.StatusBadRequest).JSON(response.Send(fiber.StatusBadRequest, fmt.Sprintf("Unknown record type %s.", value), nil))
+		}
+	}
+
+	name := ctx.Query("name")
+	if _, ok := record.IsDomainName(name); !ok {
+		return ctx.Status(fiber.StatusBadRequest).JSON(response.Send(fiber.StatusBadRequest, "The name parameter is not a domain name.", nil))
+	}
+
+	r := new(record.Msg)
+	r.SetQuestion(record.Fqdn(name), qtype)
+	r.CheckingDisabled = flag(ctx.Query("cd"))
+	if flag(ctx.Query("do")) {
+		r.SetEdns0(record.DefaultMsgSize, true)
+	}
+
+	m := dns.Exchange(ctx.Context().RemoteAddr(), r)
+	message := JSONMessage{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Answer:     jsonRecords(m.Answer),
+		Authority:  jsonRecords(m.Ns),
+		Additional: jsonRecords(m.Extra),
+	}
+
+	for _, q := range m.Question {
+		message.Question = append(message.Question, JSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	setCacheControl(ctx, m)
+
+	return ctx.JSON(message, dnsJSON)
+}
+
+// jsonRecords converts the records of a section, leaving out the OPT pseudo record
+func jsonRecords(records []record.RR) []JSONRecord {
+	var converted []JSONRecord
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Rrtype == record.TypeOPT {
+			continue
+		}
+
+		converted = append(converted, JSONRecord{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+
+	return converted
+}
+
+// setCacheControl limits the freshness of the response to the smallest TTL of its records (RFC 8484 section 5.1)
+func setCacheControl(ctx *fiber.Ctx, m *record.Msg) {
+	var ttl *uint32
+	for _, section := range [][]record.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if hdr := rr.Header(); ttl == nil || hdr.Ttl < *ttl {
+				ttl = &hdr.Ttl
+			}
+		}
+	}
+
+	if ttl != nil {
+		ctx.Set(fiber.HeaderCacheControl, fmt.Sprintf("max-age=%d", *ttl))
+	}
+}
+
+// flag parses the boolean parameters of the JSON API
+func flag(value string) bool {
+	return value == "1" || strings.EqualFold(value, "true")
+}
@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"github.com/betterde/cdns/api/middleware"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/internal/metrics"
 	"github.com/betterde/cdns/internal/response"
 	"github.com/betterde/cdns/pkg/dns"
 	"github.com/gofiber/fiber/v2"
 	record "github.com/miekg/dns"
-	"strings"
 )
 
 type Request struct {
@@ -15,28 +17,40 @@ type Request struct {
 
 // Present create TXT record
 func Present(ctx *fiber.Ctx) error {
+	metrics.Challenges.WithLabelValues("present").Inc()
+
 	payload := Request{}
 	err := ctx.BodyParser(&payload)
 	if err != nil {
+		metrics.ChallengeFailures.WithLabelValues("present").Inc()
 		return ctx.JSON(response.ValidationError("Payload validation failed.", err))
 	}
 
-	for _, server := range dns.Servers {
-		txtRecord := &record.TXT{
-			Hdr: record.RR_Header{
-				Name:   payload.FQDN,
-				Rrtype: record.TypeTXT,
-				Class:  record.ClassINET,
-				Ttl:    3600,
-			},
-			Txt: []string{payload.Value},
-		}
+	if !dns.Manages(payload.FQDN) {
+		metrics.ChallengeFailures.WithLabelValues("present").Inc()
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(response.ValidationError("The fqdn is not a domain name served by this server.", nil))
+	}
+
+	if !middleware.Authorized(ctx, payload.FQDN) {
+		metrics.ChallengeFailures.WithLabelValues("present").Inc()
+		return ctx.Status(fiber.StatusForbidden).JSON(response.Forbidden("The credential is not allowed to manage this domain."))
+	}
 
-		domain := server.Domains[payload.FQDN]
-		domain.Records = append(server.Domains[payload.FQDN].Records, txtRecord)
-		server.Lock()
-		server.Domains[payload.FQDN] = domain
-		server.Unlock()
+	txtRecord := &record.TXT{
+		Hdr: record.RR_Header{
+			Name:   payload.FQDN,
+			Rrtype: record.TypeTXT,
+			Class:  record.ClassINET,
+			Ttl:    3600,
+		},
+		Txt: []string{payload.Value},
+	}
+
+	err = dns.AppendRecord(txtRecord)
+	if err != nil {
+		journal.Logger.Sugar().With("FQDN", payload.FQDN, "Error", err.Error()).Error("Failed to persist TXT record")
+		metrics.ChallengeFailures.WithLabelValues("present").Inc()
+		return ctx.JSON(response.InternalServerError("Failed to persist TXT record.", err))
 	}
 
 	return ctx.JSON(response.Success("Success", nil))
@@ -44,24 +58,25 @@ func Present(ctx *fiber.Ctx) error {
 
 // Cleanup delete TXT record
 func Cleanup(ctx *fiber.Ctx) error {
+	metrics.Challenges.WithLabelValues("cleanup").Inc()
+
 	payload := Request{}
 	err := ctx.BodyParser(&payload)
 	if err != nil {
+		metrics.ChallengeFailures.WithLabelValues("cleanup").Inc()
 		return ctx.JSON(response.ValidationError("Payload validation failed.", err))
 	}
 
-	for _, server := range dns.Servers {
-		domain := server.Domains[payload.FQDN]
-		result := make([]record.RR, 0)
-		for _, rec := range domain.Records {
-			txtSlice := rec.(*record.TXT).Txt
-			if strings.Join(txtSlice, "") != payload.Value {
-				result = append(result, rec)
-			}
-		}
-		server.Lock()
-		server.Domains[payload.FQDN] = dns.Records{Records: result}
-		server.Unlock()
+	if !middleware.Authorized(ctx, payload.FQDN) {
+		metrics.ChallengeFailures.WithLabelValues("cleanup").Inc()
+		return ctx.Status(fiber.StatusForbidden).JSON(response.Forbidden("The credential is not allowed to manage this domain."))
+	}
+
+	err = dns.RemoveTXTRecord(payload.FQDN, payload.Value)
+	if err != nil {
+		journal.Logger.Sugar().With("FQDN", payload.FQDN, "Error", err.Error()).Error("Failed to remove TXT record")
+		metrics.ChallengeFailures.WithLabelValues("cleanup").Inc()
+		return ctx.JSON(response.InternalServerError("Failed to remove TXT record.", err))
 	}
 
 	return ctx.JSON(response.Success("Success", nil))
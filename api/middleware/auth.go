@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/response"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+// CredentialKey is the key of the authenticated credential in the request locals
+const CredentialKey = "credential"
+
+// Authenticate rejects requests without a valid bearer token or X-Api-User/X-Api-Key pair.
+// Without configured credentials every request is rejected unless anonymous access is allowed.
+func Authenticate(ctx *fiber.Ctx) error {
+	conf := config.Get()
+	if len(conf.HTTP.Credentials) == 0 {
+		if conf.HTTP.AllowAnonymous {
+			return ctx.Next()
+		}
+
+		return ctx.Status(fiber.StatusUnauthorized).JSON(response.UnAuthenticated("No API credentials are configured."))
+	}
+
+	credential := authenticate(ctx)
+	if credential == nil {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(response.UnAuthenticated("Invalid or missing API credentials."))
+	}
+
+	ctx.Locals(CredentialKey, credential)
+	return ctx.Next()
+}
+
+// AuthenticateRegistration authenticates acme-dns account registrations unless open registration is enabled
+func AuthenticateRegistration(ctx *fiber.Ctx) error {
+	if config.Get().HTTP.OpenRegistration {
+		return ctx.Next()
+	}
+
+	return Authenticate(ctx)
+}
+
+// AuthenticateAdmin only accepts credentials that are not restricted to specific domains,
+// the admin API is closed while no credentials are configured
+func AuthenticateAdmin(ctx *fiber.Ctx) error {
+	if len(config.Get().HTTP.Credentials) == 0 {
+		return ctx.Status(fiber.StatusForbidden).JSON(response.Forbidden("The admin API requires API credentials to be configured."))
+	}
+
+	credential := authenticate(ctx)
+	if credential == nil {
+		return ctx.Status(fiber.StatusUnauthorized).JSON(response.UnAuthenticated("Invalid or missing API credentials."))
+	}
+
+	if len(credential.Domains) > 0 {
+		return ctx.Status(fiber.StatusForbidden).JSON(response.Forbidden("The credential is not allowed to administer the server."))
+	}
+
+	ctx.Locals(CredentialKey, credential)
+	return ctx.Next()
+}
+
+// authenticate returns the configured credential matching the request headers
+func authenticate(ctx *fiber.Ctx) *config.Credential {
+	token := ""
+	authorization := ctx.Get(fiber.HeaderAuthorization)
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		token = strings.TrimSpace(authorization[7:])
+	}
+
+	username := ctx.Get("X-Api-User")
+	key := ctx.Get("X-Api-Key")
+
+	credentials := config.Get().HTTP.Credentials
+	for i, credential := range credentials {
+		if token != "" && credential.Token != "" && equal(token, credential.Token) {
+			return &credentials[i]
+		}
+
+		if username != "" && credential.Username != "" && credential.Key != "" &&
+			equal(username, credential.Username) && equal(key, credential.Key) {
+			return &credentials[i]
+		}
+	}
+
+	return nil
+}
+
+// equal compares secrets in constant time
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/match"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+// Authorized reports whether the credential of the request may manage records for fqdn.
+// Requests without a credential or with an unrestricted credential are always authorized.
+func Authorized(ctx *fiber.Ctx, fqdn string) bool {
+	credential, ok := ctx.Locals(CredentialKey).(*config.Credential)
+	if !ok || len(credential.Domains) == 0 {
+		return true
+	}
+
+	name := normalize(fqdn)
+	if name == "" {
+		return false
+	}
+
+	for _, pattern := range credential.Domains {
+		if match.Domain(name, normalize(pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
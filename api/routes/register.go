@@ -2,10 +2,13 @@ package routes
 
 import (
 	"github.com/betterde/cdns/api/handler"
+	"github.com/betterde/cdns/api/middleware"
 	"github.com/betterde/cdns/internal/response"
 	"github.com/betterde/cdns/spa"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func RegisterRoutes(app *fiber.App) {
@@ -13,8 +16,20 @@ func RegisterRoutes(app *fiber.App) {
 		return ctx.JSON(response.Success("Success", nil))
 	}).Name("Health check")
 
-	app.Post("/present", handler.Present).Name("Create TXT record")
-	app.Post("/cleanup", handler.Cleanup).Name("Cleanup TXT record")
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler())).Name("Prometheus metrics")
+
+	app.Post("/present", middleware.Authenticate, handler.Present).Name("Create TXT record")
+	app.Post("/cleanup", middleware.Authenticate, handler.Cleanup).Name("Cleanup TXT record")
+
+	// acme-dns compatible API
+	app.Post("/register", middleware.AuthenticateRegistration, handler.Register).Name("Register acme-dns account")
+	app.Post("/update", handler.Update).Name("Update acme-dns TXT record")
+
+	app.Post("/admin/reload", middleware.AuthenticateAdmin, handler.Reload).Name("Reload configuration")
+
+	// DNS-over-HTTPS (RFC 8484) and the JSON API
+	app.Get("/dns-query", handler.Query).Name("DNS query")
+	app.Post("/dns-query", handler.QueryMessage).Name("DNS query message")
 
 	// Embed SPA static resource
 	app.Get("*", filesystem.New(filesystem.Config{
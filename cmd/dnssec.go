@@ -0,0 +1,221 @@
+/*
+Copyright © 2024 George <george@betterde.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/pkg/dns"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	record "github.com/miekg/dns"
+)
+
+var (
+	digest           string
+	rolloverKSK      bool
+	rolloverZSK      bool
+	rolloverComplete bool
+)
+
+// dnssecCmd represents the dnssec command
+var dnssecCmd = &cobra.Command{
+	Use:   "dnssec",
+	Short: "Manage the DNSSEC keys of the served zones",
+}
+
+// dsCmd represents the dnssec ds command
+var dsCmd = &cobra.Command{
+	Use:   "ds [zone...]",
+	Short: "Print the DS records to publish at the parent zones",
+	Run: func(cmd *cobra.Command, args []string) {
+		digestType, ok := record.StringToHash[strings.ToUpper(digest)]
+		if !ok {
+			journal.Logger.Sugar().Errorf("Unsupported digest type %s", digest)
+			os.Exit(1)
+		}
+
+		for _, zone := range signedZones(args) {
+			for _, ds := range zone.DS(digestType, time.Now()) {
+				fmt.Println(ds.String())
+			}
+		}
+	},
+}
+
+// keysCmd represents the dnssec keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys [zone...]",
+	Short: "List the DNSSEC keys and their rollover timing",
+	Run: func(cmd *cobra.Command, args []string) {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(writer, "ZONE\tROLE\tKEY TAG\tALGORITHM\tPUBLISH\tACTIVATE\tINACTIVE\tDELETE")
+
+		for _, zone := range signedZones(args) {
+			for _, key := range zone.Keys {
+				_, _ = fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+					zone.Origin,
+					key.Role(),
+					key.DNSKEY.KeyTag(),
+					record.AlgorithmToString[key.DNSKEY.Algorithm],
+					formatKeyTime(key.State.Publish),
+					formatKeyTime(key.State.Activate),
+					formatKeyTime(key.State.Inactive),
+					formatKeyTime(key.State.Delete),
+				)
+			}
+		}
+
+		if err := writer.Flush(); err != nil {
+			journal.Logger.Sugar().Error(err)
+			os.Exit(1)
+		}
+	},
+}
+
+// rolloverCmd represents the dnssec rollover command
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover [zone...]",
+	Short: "Start the due ZSK rollovers, force one with --zsk or --ksk, or complete a KSK rollover with --complete",
+	Long: `Start the pre-publish rollovers of the ZSKs that exceeded the configured lifetime, meant to be run on a schedule.
+With --zsk or --ksk a rollover is started regardless of the key lifetime.
+KSK rollovers are never started or completed automatically: the old KSK keeps signing until the DS record of the new one
+is published at the parent zone and the rollover is completed with --complete.
+A running server publishes the key changes within an hour, or immediately after receiving SIGHUP.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		now := time.Now()
+		for _, zone := range signedZones(args) {
+			if rolloverComplete {
+				retired, err := zone.CompleteRollover(now)
+				if err != nil {
+					journal.Logger.Sugar().Errorf("Unable to complete the KSK rollover of %s: %v", zone.Origin, err)
+					os.Exit(1)
+				}
+
+				for _, key := range retired {
+					fmt.Printf("%s: old KSK %d is removed at %s\n", zone.Origin, key.DNSKEY.KeyTag(), formatKeyTime(key.State.Delete))
+				}
+				continue
+			}
+
+			var err error
+			var successors []*dns.Key
+			if rolloverKSK || rolloverZSK {
+				for _, ksk := range []bool{true, false} {
+					if (ksk && !rolloverKSK) || (!ksk && !rolloverZSK) {
+						continue
+					}
+
+					var successor *dns.Key
+					successor, err = zone.Rollover(ksk, now)
+					if err != nil {
+						break
+					}
+					successors = append(successors, successor)
+				}
+			} else {
+				var successor *dns.Key
+				successor, err = zone.ScheduledRollover(now)
+				if successor != nil {
+					successors = append(successors, successor)
+				}
+
+				if zone.KSKOverdue(now) {
+					fmt.Printf("%s: the KSK exceeded its lifetime, start a rollover with --ksk\n", zone.Origin)
+				}
+			}
+
+			if err != nil {
+				journal.Logger.Sugar().Errorf("Unable to roll over the keys of %s: %v", zone.Origin, err)
+				os.Exit(1)
+			}
+
+			for _, key := range successors {
+				fmt.Printf("%s: new %s %d is published now and activated at %s\n", zone.Origin, key.Role(), key.DNSKEY.KeyTag(), formatKeyTime(key.State.Activate))
+				if key.IsKSK() {
+					fmt.Printf("%s: once it is active, publish this DS record at the parent zone, remove the old one and run rollover --complete\n%s\n", zone.Origin, key.DNSKEY.ToDS(record.SHA256).String())
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dnssecCmd)
+	dnssecCmd.AddCommand(dsCmd, keysCmd, rolloverCmd)
+
+	dsCmd.Flags().StringVar(&digest, "digest", "SHA256", "Digest type of the DS records, SHA1, SHA256 or SHA384")
+	rolloverCmd.Flags().BoolVar(&rolloverKSK, "ksk", false, "Start a KSK rollover")
+	rolloverCmd.Flags().BoolVar(&rolloverZSK, "zsk", false, "Start a ZSK rollover")
+	rolloverCmd.Flags().BoolVar(&rolloverComplete, "complete", false, "Retire the old KSK once the DS record of the new KSK is published at the parent zone")
+	rolloverCmd.MarkFlagsMutuallyExclusive("complete", "ksk")
+	rolloverCmd.MarkFlagsMutuallyExclusive("complete", "zsk")
+}
+
+// signedZones loads the signed zones, limited to the given origins
+func signedZones(origins []string) []*dns.Zone {
+	if !config.Get().DNS.DNSSEC.Enabled {
+		journal.Logger.Sugar().Error("DNSSEC is not enabled")
+		os.Exit(1)
+	}
+
+	zones, err := dns.LoadZones(config.Get())
+	if err != nil {
+		journal.Logger.Sugar().Error("Unable to load zones:", err)
+		os.Exit(1)
+	}
+
+	if len(origins) == 0 {
+		return zones
+	}
+
+	selected := make([]*dns.Zone, 0, len(origins))
+	for _, origin := range origins {
+		found := false
+		for _, zone := range zones {
+			if zone.Origin == strings.ToLower(record.Fqdn(origin)) {
+				selected = append(selected, zone)
+				found = true
+			}
+		}
+
+		if !found {
+			journal.Logger.Sugar().Errorf("Zone %s is not served", origin)
+			os.Exit(1)
+		}
+	}
+
+	return selected
+}
+
+func formatKeyTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format(time.RFC3339)
+}
@@ -69,19 +69,32 @@ func signalHandler(errChan chan error, cancel context.CancelFunc) error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
-	select {
-	case <-shutdown:
-		cancel()
-		for _, server := range dns.Servers {
-			err := server.Server.Shutdown()
-			if err != nil {
-				journal.Logger.Sugar().Error("Failed to shutdown server:", err)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-reload:
+			if err := dns.Reload(); err != nil {
+				journal.Logger.Sugar().Error("Failed to reload configuration:", err)
+			}
+		case <-shutdown:
+			cancel()
+			if dns.ServerInstance != nil {
+				if err := dns.ServerInstance.Shutdown(); err != nil {
+					journal.Logger.Sugar().Error("Failed to shutdown server:", err)
+				}
+			}
+			if dns.Store != nil {
+				if err := dns.Store.Close(); err != nil {
+					journal.Logger.Sugar().Error("Failed to close record store:", err)
+				}
 			}
+			return api.ServerInstance.Engine.Shutdown()
+		case err := <-errChan:
+			cancel()
+			journal.Logger.Sugar().Panic(err)
+			return api.ServerInstance.Engine.Shutdown()
 		}
-		return api.ServerInstance.Engine.Shutdown()
-	case err := <-errChan:
-		cancel()
-		journal.Logger.Sugar().Panic(err)
-		return api.ServerInstance.Engine.Shutdown()
 	}
 }
@@ -6,12 +6,21 @@ import (
 	"github.com/spf13/viper"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const TLSModeACME = "acme"
 const TLSModeFile = "file"
 
-var Conf *Config
+const StorageDriverBolt = "bolt"
+const StorageDriverMemory = "memory"
+
+const SerialSchemeDate = "date"
+const SerialSchemeUnixtime = "unixtime"
+
+// current is the configuration in use, replaced as a whole on reload while handlers read it
+var current atomic.Pointer[Config]
 
 type Config struct {
 	NS        NS        `yaml:"ns" mapstructure:"NS"`
@@ -21,37 +30,142 @@ type Config struct {
 	Ingress   Ingress   `yaml:"ingress" mapstructure:"INGRESS"`
 	Logging   Logging   `yaml:"logging" mapstructure:"LOGGING"`
 	Providers Providers `yaml:"providers" mapstructure:"PROVIDERS"`
+	Storage   Storage   `yaml:"storage" mapstructure:"STORAGE"`
 }
 
+// NS is the address of the name server, IP and Addresses may both be IPv4 or IPv6
 type NS struct {
-	IP string `yaml:"ip" mapstructure:"IP"`
+	IP        string   `yaml:"ip" mapstructure:"IP"`
+	Addresses []string `yaml:"addresses" mapstructure:"ADDRESSES"`
 }
 
 type Logging struct {
 	Level string `yaml:"level" mapstructure:"LEVEL"`
 }
 
+// DNS configures the zone built from the global settings and the other zones,
+// NameServers replaces NSName and the NS IP of the global zone when not empty,
+// and Listeners replaces Listen and Protocol when not empty.
 type DNS struct {
-	Admin    string            `yaml:"admin" mapstructure:"ADMIN"`
-	Listen   string            `yaml:"listen" mapstructure:"LISTEN"`
-	NSName   string            `yaml:"nsname" mapstructure:"NSNAME"`
-	Records  map[string]Record `yaml:"records" mapstructure:"RECORDS"`
-	Protocol string            `yaml:"protocol" mapstructure:"PROTOCOL"`
+	Admin       string         `yaml:"admin" mapstructure:"ADMIN"`
+	Listen      string         `yaml:"listen" mapstructure:"LISTEN"`
+	NSName      string         `yaml:"nsname" mapstructure:"NSNAME"`
+	Listeners   []Listener     `yaml:"listeners" mapstructure:"LISTENERS"`
+	Zones       []Zone         `yaml:"zones" mapstructure:"ZONES"`
+	NameServers []NameServer   `yaml:"nameservers" mapstructure:"NAMESERVERS"`
+	TSIG        []TSIGKey      `yaml:"tsig" mapstructure:"TSIG"`
+	DNSSEC      DNSSEC         `yaml:"dnssec" mapstructure:"DNSSEC"`
+	Serial      string         `yaml:"serial" mapstructure:"SERIAL"`
+	Update      []UpdatePolicy `yaml:"update" mapstructure:"UPDATE"`
+	Records     Records        `yaml:"records" mapstructure:"RECORDS"`
+	Protocol    string         `yaml:"protocol" mapstructure:"PROTOCOL"`
+	Transfer    Transfer       `yaml:"transfer" mapstructure:"TRANSFER"`
+	QueryLog    QueryLog       `yaml:"queryLog" mapstructure:"QUERYLOG"`
+}
+
+// QueryLog writes a record of every DNS request regardless of the log level. JSON is a file of JSON lines or "stdout",
+// Dnstap is a file or a "unix://" socket receiving dnstap frame streams, empty disables the output.
+type QueryLog struct {
+	JSON   string `yaml:"json" mapstructure:"JSON"`
+	Dnstap string `yaml:"dnstap" mapstructure:"DNSTAP"`
+}
+
+// Listener is an address the DNS server listens on, the protocol is "udp" or "tcp" optionally suffixed with 4 or 6,
+// "tcp-tls" for DNS-over-TLS or "quic" for DNS-over-QUIC
+type Listener struct {
+	Listen   string `yaml:"listen" mapstructure:"LISTEN"`
+	Protocol string `yaml:"protocol" mapstructure:"PROTOCOL"`
+}
+
+// TSIGKey is a shared secret authenticating DNS messages (RFC 8945), the secret is base64 encoded
+type TSIGKey struct {
+	Name      string `yaml:"name" mapstructure:"NAME"`
+	Secret    string `yaml:"secret" mapstructure:"SECRET"`
+	Algorithm string `yaml:"algorithm" mapstructure:"ALGORITHM"`
+}
+
+// UpdatePolicy allows RFC 2136 UPDATE requests signed with the TSIG key. Zones limits the zones by origin,
+// Names are suffixes or glob patterns like the domains of credentials and Types limits the record types, empty means any.
+type UpdatePolicy struct {
+	Key   string   `yaml:"key" mapstructure:"KEY"`
+	Zones []string `yaml:"zones" mapstructure:"ZONES"`
+	Names []string `yaml:"names" mapstructure:"NAMES"`
+	Types []string `yaml:"types" mapstructure:"TYPES"`
+}
+
+// Transfer allows secondaries to transfer the zones with AXFR and IXFR over TCP.
+// Transfers are refused unless the client address is in Allow, and when Keys is not empty
+// the request must also be signed with one of the named TSIG keys, which also signs the NOTIFY messages.
+type Transfer struct {
+	Keys   []string `yaml:"keys" mapstructure:"KEYS"`
+	Allow  []string `yaml:"allow" mapstructure:"ALLOW"`
+	Notify []string `yaml:"notify" mapstructure:"NOTIFY"`
+}
+
+// DNSSEC signs every zone online, keys are read from or generated into KeyDir.
+// ZSKs older than their lifetime are rolled over automatically, KSKs are only reported. A zero lifetime disables it.
+type DNSSEC struct {
+	KeyDir      string        `yaml:"keyDir" mapstructure:"KEYDIR"`
+	Enabled     bool          `yaml:"enabled" mapstructure:"ENABLED"`
+	Algorithm   string        `yaml:"algorithm" mapstructure:"ALGORITHM"`
+	Propagation time.Duration `yaml:"propagation" mapstructure:"PROPAGATION"`
+	KSKLifetime time.Duration `yaml:"kskLifetime" mapstructure:"KSKLIFETIME"`
+	ZSKLifetime time.Duration `yaml:"zskLifetime" mapstructure:"ZSKLIFETIME"`
+}
+
+// Zone is a zone the server is authoritative for. Its records come either from an RFC 1035 master file,
+// whose origin defaults to the $ORIGIN or SOA owner in the file, or from the SOA, NS and records configured here.
+// NameServers replaces NSName and NS when not empty, the first one is the primary in the SOA.
+type Zone struct {
+	NS          NS           `yaml:"ns" mapstructure:"NS"`
+	SOA         Timers       `yaml:"soa" mapstructure:"SOA"`
+	File        string       `yaml:"file" mapstructure:"FILE"`
+	Admin       string       `yaml:"admin" mapstructure:"ADMIN"`
+	NSName      string       `yaml:"nsname" mapstructure:"NSNAME"`
+	Origin      string       `yaml:"origin" mapstructure:"ORIGIN"`
+	Ingress     Ingress      `yaml:"ingress" mapstructure:"INGRESS"`
+	Records     Records      `yaml:"records" mapstructure:"RECORDS"`
+	NameServers []NameServer `yaml:"nameservers" mapstructure:"NAMESERVERS"`
 }
 
 type HTTP struct {
-	TLS    TLS    `yaml:"tls" mapstructure:"TLS"`
-	Domain string `yaml:"domain" mapstructure:"DOMAIN"`
-	Listen string `yaml:"listen" mapstructure:"LISTEN"`
+	TLS         TLS          `yaml:"tls" mapstructure:"TLS"`
+	Domain      string       `yaml:"domain" mapstructure:"DOMAIN"`
+	Listen      string       `yaml:"listen" mapstructure:"LISTEN"`
+	Credentials []Credential `yaml:"credentials" mapstructure:"CREDENTIALS"`
+	// OpenRegistration allows acme-dns clients to register accounts without API credentials
+	OpenRegistration bool `yaml:"openRegistration" mapstructure:"OPENREGISTRATION"`
+	// AllowAnonymous opens the record API to everyone while no credentials are configured, the admin API stays closed
+	AllowAnonymous bool `yaml:"allowAnonymous" mapstructure:"ALLOWANONYMOUS"`
+}
+
+// Credential authenticates API requests either by a bearer token or by a username and key pair.
+// Domains limits the names the credential may manage to the listed suffixes or glob patterns.
+type Credential struct {
+	Key      string   `yaml:"key" mapstructure:"KEY"`
+	Token    string   `yaml:"token" mapstructure:"TOKEN"`
+	Domains  []string `yaml:"domains" mapstructure:"DOMAINS"`
+	Username string   `yaml:"username" mapstructure:"USERNAME"`
 }
 
+// Records are static records, every entry maps owner names to a record. A name may appear in several entries
+// so that it can hold records of different types, the entries are a list because viper splits map keys on dots.
+type Records []map[string]Record
+
+// Record holds static records of a domain, values are the RDATA in RFC 1035 presentation format, e.g. "10 mail.svc.dev." for MX
 type Record struct {
-	Type  string `yaml:"type" mapstructure:"TYPE"`
-	Value string `yaml:"value" mapstructure:"VALUE"`
+	TTL    uint32   `yaml:"ttl" mapstructure:"TTL"`
+	Type   string   `yaml:"type" mapstructure:"TYPE"`
+	Value  string   `yaml:"value" mapstructure:"VALUE"`
+	Values []string `yaml:"values" mapstructure:"VALUES"`
 }
 
+// Ingress is the address of the names that do not exist in a zone when the wildcard is enabled,
+// A queries are answered with the IPv4 and AAAA queries with the IPv6 addresses of IP and Addresses
 type Ingress struct {
-	IP string `yaml:"ip" mapstructure:"IP"`
+	IP        string   `yaml:"ip" mapstructure:"IP"`
+	Wildcard  bool     `yaml:"wildcard" mapstructure:"WILDCARD"`
+	Addresses []string `yaml:"addresses" mapstructure:"ADDRESSES"`
 }
 
 type Providers struct {
@@ -65,6 +179,27 @@ type TLS struct {
 
 type SOA struct {
 	Domain string `yaml:"domain" mapstructure:"DOMAIN"`
+	Timers `yaml:",inline" mapstructure:",squash"`
+}
+
+// Timers are the SOA values in seconds, zero values fall back to the global SOA settings and then to the defaults
+type Timers struct {
+	TTL     uint32 `yaml:"ttl" mapstructure:"TTL"`
+	Retry   uint32 `yaml:"retry" mapstructure:"RETRY"`
+	Expire  uint32 `yaml:"expire" mapstructure:"EXPIRE"`
+	Refresh uint32 `yaml:"refresh" mapstructure:"REFRESH"`
+	Minimum uint32 `yaml:"minimum" mapstructure:"MINIMUM"`
+}
+
+// NameServer is a name server of a zone, addresses of names inside the zone are served as glue A and AAAA records
+type NameServer struct {
+	Name      string   `yaml:"name" mapstructure:"NAME"`
+	Addresses []string `yaml:"addresses" mapstructure:"ADDRESSES"`
+}
+
+type Storage struct {
+	Path   string `yaml:"path" mapstructure:"PATH"`
+	Driver string `yaml:"driver" mapstructure:"DRIVER"`
 }
 
 type ACME struct {
@@ -100,12 +235,18 @@ func Parse(file string) {
 		viper.SetDefault("DNS.PROTOCOL", "both")
 		viper.SetDefault("HTTP.LISTEN", "0.0.0.0:443")
 		viper.SetDefault("LOGGING.LEVEL", "DEBUG")
+		viper.SetDefault("STORAGE.DRIVER", StorageDriverMemory)
 
 		err = viper.BindEnv("NS.IP", "CDNS_NS_IP")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
 		}
 
+		err = viper.BindEnv("NS.ADDRESSES", "CDNS_NS_ADDRESSES")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
 		err = viper.BindEnv("DNS.ADMIN", "CDNS_DNS_ADMIN")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
@@ -126,11 +267,81 @@ func Parse(file string) {
 			journal.Logger.Sugar().Error(err)
 		}
 
+		err = viper.BindEnv("DNS.SERIAL", "CDNS_DNS_SERIAL")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.QUERYLOG.JSON", "CDNS_DNS_QUERYLOG_JSON")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.QUERYLOG.DNSTAP", "CDNS_DNS_QUERYLOG_DNSTAP")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.KEYDIR", "CDNS_DNS_DNSSEC_KEYDIR")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.ENABLED", "CDNS_DNS_DNSSEC_ENABLED")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.ALGORITHM", "CDNS_DNS_DNSSEC_ALGORITHM")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.PROPAGATION", "CDNS_DNS_DNSSEC_PROPAGATION")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.KSKLIFETIME", "CDNS_DNS_DNSSEC_KSKLIFETIME")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("DNS.DNSSEC.ZSKLIFETIME", "CDNS_DNS_DNSSEC_ZSKLIFETIME")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
 		err = viper.BindEnv("SOA.DOMAIN", "CDNS_SOA_DOMAIN")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
 		}
 
+		err = viper.BindEnv("SOA.TTL", "CDNS_SOA_TTL")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("SOA.REFRESH", "CDNS_SOA_REFRESH")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("SOA.RETRY", "CDNS_SOA_RETRY")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("SOA.EXPIRE", "CDNS_SOA_EXPIRE")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("SOA.MINIMUM", "CDNS_SOA_MINIMUM")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
 		err = viper.BindEnv("HTTP.TLS.MODE", "CDNS_HTTP_TLS_MODE")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
@@ -146,11 +357,31 @@ func Parse(file string) {
 			journal.Logger.Sugar().Error(err)
 		}
 
+		err = viper.BindEnv("HTTP.OPENREGISTRATION", "CDNS_HTTP_OPENREGISTRATION")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("HTTP.ALLOWANONYMOUS", "CDNS_HTTP_ALLOWANONYMOUS")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
 		err = viper.BindEnv("INGRESS.IP", "CDNS_INGRESS_IP")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
 		}
 
+		err = viper.BindEnv("INGRESS.ADDRESSES", "CDNS_INGRESS_ADDRESSES")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("INGRESS.WILDCARD", "CDNS_INGRESS_WILDCARD")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
 		err = viper.BindEnv("LOGGING.LEVEL", "CDNS_LOGGING_LEVEL")
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
@@ -180,14 +411,52 @@ func Parse(file string) {
 		if err != nil {
 			journal.Logger.Sugar().Error(err)
 		}
+
+		err = viper.BindEnv("STORAGE.PATH", "CDNS_STORAGE_PATH")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
+
+		err = viper.BindEnv("STORAGE.DRIVER", "CDNS_STORAGE_DRIVER")
+		if err != nil {
+			journal.Logger.Sugar().Error(err)
+		}
 	}
 
 	// read in environment variables that match
 	viper.AutomaticEnv()
 
-	err := viper.Unmarshal(&Conf)
+	conf := &Config{}
+	err := viper.Unmarshal(conf)
 	if err != nil {
 		journal.Logger.Sugar().Errorf("Unable to decode into config struct, %v", err)
 		os.Exit(1)
 	}
+
+	current.Store(conf)
+}
+
+// Get returns the configuration in use, callers reading several settings should keep the returned pointer
+func Get() *Config {
+	return current.Load()
+}
+
+// Load re-reads the configuration file, the returned configuration is only used once passed to Set
+func Load() (*Config, error) {
+	var notFoundError viper.ConfigFileNotFoundError
+	if err := viper.ReadInConfig(); err != nil && !errors.As(err, &notFoundError) {
+		return nil, err
+	}
+
+	conf := &Config{}
+	if err := viper.Unmarshal(conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// Set replaces the current configuration
+func Set(conf *Config) {
+	current.Store(conf)
 }
@@ -0,0 +1,21 @@
+package match
+
+import (
+	"path"
+	"strings"
+)
+
+// Domain matches a lowercase name without the trailing dot against a glob pattern,
+// or against a suffix when the pattern has no wildcard
+func Domain(name, pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, name)
+		return err == nil && matched
+	}
+
+	return name == pattern || strings.HasSuffix(name, "."+pattern)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "cdns"
+
+var (
+	// Queries counts the answered DNS requests
+	Queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "DNS requests answered, by query type, response code, protocol and zone.",
+	}, []string{"qtype", "rcode", "protocol", "zone"})
+
+	// QueryDuration observes how long answering a DNS request takes
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "query_duration_seconds",
+		Help:      "Time taken to answer DNS requests, by protocol.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"protocol"})
+
+	// Challenges counts the calls of the record API
+	Challenges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "challenge",
+		Name:      "calls_total",
+		Help:      "Calls of the record API, by operation.",
+	}, []string{"operation"})
+
+	// ChallengeFailures counts the calls of the record API that did not succeed
+	ChallengeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "challenge",
+		Name:      "failures_total",
+		Help:      "Calls of the record API that did not succeed, by operation.",
+	}, []string{"operation"})
+)
+
+// GaugeFunc registers a gauge whose value is read on every scrape
+func GaugeFunc(subsystem, name, help string, labels prometheus.Labels, value func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, value))
+}
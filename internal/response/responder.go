@@ -38,6 +38,15 @@ func UnAuthenticated(message string) Response {
 	}
 }
 
+// Forbidden Authorization Failure
+func Forbidden(message string) Response {
+	return Response{
+		Code:    http.StatusForbidden,
+		Message: message,
+		Data:    struct{}{},
+	}
+}
+
 func NotFound(message string) Response {
 	return Response{
 		Code:    http.StatusNotFound,
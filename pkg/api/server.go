@@ -1,13 +1,16 @@
 package api
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/betterde/cdns/api/routes"
 	"github.com/betterde/cdns/config"
 	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/internal/metrics"
 	"github.com/betterde/cdns/internal/response"
 	"github.com/betterde/cdns/pkg/challenge"
 	"github.com/betterde/cdns/pkg/dns"
@@ -18,7 +21,9 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/pprof"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"time"
 )
 
 var ServerInstance *Server
@@ -72,83 +77,133 @@ func (s *Server) Run(verbose bool, errChan chan error) {
 	ServerInstance.Engine.Use(recover.New())
 	ServerInstance.Engine.Use(requestid.New())
 
-	go func() {
-		tlsConf := &tls.Config{
-			MinVersion: tls.VersionTLS11,
-			MaxVersion: tls.VersionTLS13,
+	if conf := config.Get(); len(conf.HTTP.Credentials) == 0 {
+		if conf.HTTP.AllowAnonymous {
+			journal.Logger.Sugar().Warn("No API credentials configured, the record API is open to anyone who can reach it")
+		} else {
+			journal.Logger.Sugar().Warn("No API credentials configured, the API rejects every request until http.credentials or http.allowAnonymous is set")
 		}
+	}
 
-		switch config.Conf.HTTP.TLS.Mode {
-		case config.TLSModeACME:
-			provider := challenge.NewChallengeProvider(dns.Servers)
-			storage := certmagic.FileStorage{Path: config.Conf.Providers.ACME.Storage}
-
-			certmagic.DefaultACME.CA = config.Conf.Providers.ACME.Server
-			certmagic.DefaultACME.Email = config.Conf.Providers.ACME.Email
-			certmagic.DefaultACME.Agreed = true
-			certmagic.DefaultACME.Logger = journal.Logger
-			certmagic.DefaultACME.TestCA = config.Conf.Providers.ACME.Server
-			certmagic.DefaultACME.DNS01Solver = &provider
-
-			magicConf := &certmagic.Config{}
-			magicConf.OCSP = certmagic.OCSPConfig{
-				DisableStapling: true,
-			}
-			magicConf.Logger = journal.Logger
-			magicConf.Storage = &storage
-			magicConf.DefaultServerName = config.Conf.HTTP.Domain
+	go func() {
+		tlsConf, expiry, err := tlsConfig()
+		if err != nil {
+			errChan <- err
+			return
+		}
 
-			magicCache := certmagic.NewCache(certmagic.CacheOptions{
-				Logger: journal.Logger,
-				GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
-					return magicConf, nil
-				},
-			})
+		if tlsConf != nil {
+			metrics.GaugeFunc("tls", "certificate_expiry_timestamp_seconds", "Expiry of the certificate served for the domain, zero while there is none.",
+				prometheus.Labels{"domain": config.Get().HTTP.Domain}, expiry)
+		}
 
-			magicConf = certmagic.New(magicCache, *magicConf)
+		// The DNS-over-TLS listeners share the certificate of the HTTP server
+		if dns.ServerInstance != nil {
+			dns.ServerInstance.StartTLS(tlsConf, errChan)
+		}
 
-			err := magicConf.ManageAsync(context.Background(), []string{config.Conf.HTTP.Domain})
+		if tlsConf == nil {
+			err = ServerInstance.Engine.Listen(config.Get().HTTP.Listen)
 			if err != nil {
-				errChan <- err
-				return
+				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
 			}
+			return
+		}
 
-			tlsConf.GetCertificate = magicConf.GetCertificate
-			tlsConf.NextProtos = []string{"http/1.1", "acme-tls/1"}
+		// Create custom listener
+		ln, err := tls.Listen("tcp", config.Get().HTTP.Listen, tlsConf)
+		if err != nil {
+			journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
+		}
 
-			// Create custom listener
-			ln, err := tls.Listen("tcp", config.Conf.HTTP.Listen, tlsConf)
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
-			}
+		err = ServerInstance.Engine.Listener(ln)
+		if err != nil {
+			journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
+		}
+	}()
+}
 
-			err = ServerInstance.Engine.Listener(ln)
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
-			}
-			break
-		case config.TLSModeFile:
-			cert, err := tls.LoadX509KeyPair("certs/ssl.cert", "certs/ssl.key")
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
+// cachedExpiry returns the latest expiry of the certificates cached for the domain as a unix timestamp.
+// The cache is read directly, a certificate lookup for a handshake would try to obtain one while ACME is pending.
+func cachedExpiry(cache *certmagic.Cache, domain string) func() float64 {
+	return func() float64 {
+		var expiry time.Time
+		for _, cert := range cache.AllMatchingCertificates(domain) {
+			if cert.Leaf != nil && cert.Leaf.NotAfter.After(expiry) {
+				expiry = cert.Leaf.NotAfter
 			}
+		}
 
-			// Create custom listener
-			ln, err := tls.Listen("tcp", config.Conf.HTTP.Listen, &tls.Config{Certificates: []tls.Certificate{cert}})
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
-			}
+		if expiry.IsZero() {
+			return 0
+		}
 
-			err = ServerInstance.Engine.Listener(ln)
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
-			}
-			break
-		default:
-			err := ServerInstance.Engine.Listen(config.Conf.HTTP.Listen)
-			if err != nil {
-				journal.Logger.Sugar().Panicw("Failed to start cdns server:", err)
-			}
+		return float64(expiry.Unix())
+	}
+}
+
+// tlsConfig returns the TLS configuration of the tls mode with the expiry of its certificate for the metrics,
+// nil when the server runs without TLS
+func tlsConfig() (*tls.Config, func() float64, error) {
+	conf := config.Get()
+	switch conf.HTTP.TLS.Mode {
+	case config.TLSModeACME:
+		provider := challenge.NewChallengeProvider(dns.ServerInstance)
+		storage := certmagic.FileStorage{Path: conf.Providers.ACME.Storage}
+
+		certmagic.DefaultACME.CA = conf.Providers.ACME.Server
+		certmagic.DefaultACME.Email = conf.Providers.ACME.Email
+		certmagic.DefaultACME.Agreed = true
+		certmagic.DefaultACME.Logger = journal.Logger
+		certmagic.DefaultACME.TestCA = conf.Providers.ACME.Server
+		certmagic.DefaultACME.DNS01Solver = &provider
+
+		magicConf := &certmagic.Config{}
+		magicConf.OCSP = certmagic.OCSPConfig{
+			DisableStapling: true,
 		}
-	}()
+		magicConf.Logger = journal.Logger
+		magicConf.Storage = &storage
+		magicConf.DefaultServerName = conf.HTTP.Domain
+
+		magicCache := certmagic.NewCache(certmagic.CacheOptions{
+			Logger: journal.Logger,
+			GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
+				return magicConf, nil
+			},
+		})
+
+		magicConf = certmagic.New(magicCache, *magicConf)
+
+		err := magicConf.ManageAsync(context.Background(), []string{conf.HTTP.Domain})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS11,
+			MaxVersion:     tls.VersionTLS13,
+			NextProtos:     []string{"http/1.1", "acme-tls/1"},
+			GetCertificate: magicConf.GetCertificate,
+		}, cachedExpiry(magicCache, conf.HTTP.Domain), nil
+	case config.TLSModeFile:
+		certFile := cmp.Or(conf.Providers.File.TLSCert, "certs/ssl.cert")
+		keyFile := cmp.Or(conf.Providers.File.TLSKey, "certs/ssl.key")
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		expiry := float64(leaf.NotAfter.Unix())
+
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, func() float64 { return expiry }, nil
+	default:
+		return nil, nil, nil
+	}
 }
@@ -8,27 +8,29 @@ import (
 
 // Provider implements go-acme/lego Provider interface which is used for ACME DNS challenge handling
 type Provider struct {
-	servers []*dns.Server
+	server *dns.Server
 }
 
 // NewChallengeProvider creates a new instance of ChallengeProvider
-func NewChallengeProvider(servers []*dns.Server) Provider {
-	return Provider{servers: servers}
+func NewChallengeProvider(server *dns.Server) Provider {
+	return Provider{server: server}
 }
 
 // Present is used for making the ACME DNS challenge token available for DNS
 func (c *Provider) Present(ctx context.Context, chall acme.Challenge) error {
-	for _, s := range c.servers {
-		s.PersonalKeyAuth = chall.DNS01KeyAuthorization()
-	}
+	c.server.Lock()
+	defer c.server.Unlock()
+
+	c.server.PersonalKeyAuth = chall.DNS01KeyAuthorization()
 	return nil
 }
 
 // CleanUp is called after the run to remove the ACME DNS challenge tokens from DNS records
 func (c *Provider) CleanUp(ctx context.Context, challenge acme.Challenge) error {
-	for _, s := range c.servers {
-		s.PersonalKeyAuth = ""
-	}
+	c.server.Lock()
+	defer c.server.Unlock()
+
+	c.server.PersonalKeyAuth = ""
 	return nil
 }
 
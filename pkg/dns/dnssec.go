@@ -0,0 +1,281 @@
+package dns
+
+import (
+	"encoding/base32"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// signatureValidity is how long online signatures are valid
+	signatureValidity = 7 * 24 * time.Hour
+	// signatureSkew backdates the inception of signatures to tolerate clock skew of validators
+	signatureSkew = time.Hour
+)
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// signZone publishes the DNSKEY and NSEC3PARAM records of a zone
+func signZone(zone *Zone, conf *config.Config) error {
+	keys, err := loadKeys(zone.Origin, conf, time.Now())
+	if err != nil {
+		return err
+	}
+
+	zone.Keys = keys
+	for _, key := range keys {
+		if key.Published(time.Now()) {
+			zone.Records = append(zone.Records, key.DNSKEY)
+		}
+	}
+
+	zone.Records = append(zone.Records, &dns.NSEC3PARAM{
+		Hdr: dns.RR_Header{
+			Name:   zone.Origin,
+			Rrtype: dns.TypeNSEC3PARAM,
+			Class:  dns.ClassINET,
+			Ttl:    zone.SOA.Header().Ttl,
+		},
+		Hash: dns.SHA1,
+	})
+
+	return nil
+}
+
+// signingKeys returns the keys signing the type, every published KSK for DNSKEY so that
+// the RRset validates with the DS of the old and the new key during a KSK rollover, and
+// the most recently activated ZSK for everything else
+func (z *Zone) signingKeys(rrtype uint16, now time.Time) []*Key {
+	var zsk *Key
+	ksks := make([]*Key, 0, 1)
+	for _, key := range z.Keys {
+		if key.IsKSK() && key.Published(now) {
+			ksks = append(ksks, key)
+		}
+
+		if !key.IsKSK() && key.Active(now) && (zsk == nil || key.State.Activate.After(zsk.State.Activate)) {
+			zsk = key
+		}
+	}
+
+	if rrtype == dns.TypeDNSKEY {
+		return ksks
+	}
+
+	if zsk == nil {
+		return nil
+	}
+
+	return []*Key{zsk}
+}
+
+// sign adds RRSIGs to the answer, authority and additional sections, denial of existence is proven with NSEC3 white lies
+func (d *Server) sign(m *dns.Msg) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if !m.MsgHdr.Authoritative || len(m.Question) == 0 {
+		return
+	}
+
+	q := m.Question[0]
+	end := chainEnd(q.Name, m.Answer)
+	if zone := d.zoneForType(end, q.Qtype); zone != nil && len(zone.Keys) > 0 {
+		if m.MsgHdr.Rcode == dns.RcodeNameError {
+			m.Ns = append(m.Ns, d.denyName(zone, end)...)
+		} else if m.MsgHdr.Rcode == dns.RcodeSuccess && !hasType(m.Answer, q.Qtype) {
+			m.Ns = append(m.Ns, d.nsec3(zone, end, d.typesAt(zone, end)))
+		}
+	}
+
+	m.Answer = d.signSection(m.Answer)
+	m.Ns = d.signSection(m.Ns)
+	m.Extra = d.signSection(m.Extra)
+}
+
+// signSection appends an RRSIG after every RRset of a zone with keys
+func (d *Server) signSection(section []dns.RR) []dns.RR {
+	rrsets := groupRRsets(section)
+	signed := make([]dns.RR, 0, len(section)*2)
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		signed = append(signed, rrset...)
+
+		zone := d.zoneForType(hdr.Name, hdr.Rrtype)
+		if zone == nil || len(zone.Keys) == 0 || hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		now := time.Now()
+		for _, key := range zone.signingKeys(hdr.Rrtype, now) {
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Ttl: hdr.Ttl},
+				Algorithm:  key.DNSKEY.Algorithm,
+				KeyTag:     key.DNSKEY.KeyTag(),
+				SignerName: zone.Origin,
+				Inception:  uint32(now.Add(-signatureSkew).Unix()),
+				Expiration: uint32(now.Add(signatureValidity).Unix()),
+			}
+
+			if err := sig.Sign(key.Signer, rrset); err != nil {
+				journal.Logger.Sugar().With("Domain", hdr.Name, "Type", dns.TypeToString[hdr.Rrtype], "Error", err.Error()).Error("Unable to sign RRset")
+				continue
+			}
+
+			signed = append(signed, sig)
+		}
+	}
+
+	return signed
+}
+
+// groupRRsets splits a section into RRsets by owner name and type, the records of an RRset need not be adjacent.
+// RRsets keep the order of their first record so that CNAME chains stay in order.
+func groupRRsets(section []dns.RR) [][]dns.RR {
+	type key struct {
+		name   string
+		rrtype uint16
+	}
+
+	index := make(map[key]int)
+	rrsets := make([][]dns.RR, 0, len(section))
+	for _, rr := range section {
+		k := key{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if i, ok := index[k]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+
+		index[k] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+
+	return rrsets
+}
+
+// denyName proves that a name does not exist with the closest encloser, next closer and wildcard NSEC3 records
+func (d *Server) denyName(zone *Zone, name string) []dns.RR {
+	encloser := zone.Origin
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i < len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(zone.Origin, candidate) {
+			break
+		}
+
+		if d.nameExists(candidate) {
+			encloser = candidate
+			break
+		}
+	}
+
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+
+	records := []dns.RR{d.nsec3(zone, encloser, d.typesAt(zone, encloser))}
+	for _, covered := range []string{nextCloser, "*." + encloser} {
+		rr := d.coveringNSEC3(zone, covered)
+		if !strings.EqualFold(rr.Hdr.Name, records[len(records)-1].Header().Name) {
+			records = append(records, rr)
+		}
+	}
+
+	return records
+}
+
+// nsec3 returns the NSEC3 record matching a name with the types it owns
+func (d *Server) nsec3(zone *Zone, name string, types []uint16) *dns.NSEC3 {
+	hash := dns.HashName(name, dns.SHA1, 0, "")
+	return d.newNSEC3(zone, hash, shiftHash(hash, 1), types)
+}
+
+// coveringNSEC3 returns a minimally covering NSEC3 record for the hash of a name
+func (d *Server) coveringNSEC3(zone *Zone, name string) *dns.NSEC3 {
+	hash := dns.HashName(name, dns.SHA1, 0, "")
+	return d.newNSEC3(zone, shiftHash(hash, -1), shiftHash(hash, 1), nil)
+}
+
+func (d *Server) newNSEC3(zone *Zone, owner, next string, types []uint16) *dns.NSEC3 {
+	ttl := uint32(defaultTTL)
+	if soa, ok := d.negativeSOA(zone.Origin).(*dns.SOA); ok {
+		ttl = soa.Hdr.Ttl
+	}
+
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(owner) + "." + zone.Origin,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// typesAt returns the types owned by a name, including those synthesized from a wildcard or the ingress
+func (d *Server) typesAt(zone *Zone, name string) []uint16 {
+	// At the cut of a nested zone the parent only owns the delegation
+	if child := d.zoneFor(name); child != nil && child != zone {
+		if len(child.DS(dns.SHA256, time.Now())) == 0 {
+			return []uint16{dns.TypeNS}
+		}
+
+		return []uint16{dns.TypeNS, dns.TypeDS, dns.TypeRRSIG}
+	}
+
+	seen := make(map[uint16]bool)
+	records := d.Domains[strings.ToLower(name)].Records
+	if len(records) == 0 && !d.nameExists(name) {
+		if source, ok := d.wildcardSource(name); ok {
+			records = d.Domains[source].Records
+		} else {
+			for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if len(zone.ingressRecords(name, rrtype)) > 0 {
+					seen[rrtype] = true
+				}
+			}
+		}
+	}
+
+	for _, rr := range records {
+		seen[rr.Header().Rrtype] = true
+	}
+
+	types := make([]uint16, 0, len(seen)+1)
+	for rrtype := range seen {
+		types = append(types, rrtype)
+	}
+
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+// shiftHash adds delta to a base32hex encoded NSEC3 hash
+func shiftHash(hash string, delta int64) string {
+	raw, err := base32Hex.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+
+	modulus := new(big.Int).Lsh(big.NewInt(1), uint(len(raw)*8))
+	value := new(big.Int).SetBytes(raw)
+	value.Add(value, big.NewInt(delta))
+	value.Mod(value, modulus)
+
+	shifted := make([]byte, len(raw))
+	value.FillBytes(shifted)
+
+	return base32Hex.EncodeToString(shifted)
+}
@@ -0,0 +1,265 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signedZone = `  dnssec:
+    enabled: true
+  records:
+    - www.example.test:
+        type: A
+        value: 192.0.2.10
+    - a.b.example.test:
+        type: A
+        value: 192.0.2.11
+`
+
+func TestSignSection(t *testing.T) {
+	useConfig(t, signedZone)
+	server := newTestServer(t)
+	zone := server.zoneFor(testOrigin)
+
+	tests := []struct {
+		name    string
+		section []string
+		// rrsets are the expected owner and type of every RRset in order, each followed by its signatures
+		rrsets []string
+		sigs   int
+	}{
+		{
+			name:    "adjacent RRset",
+			section: []string{"www.example.test. 300 IN A 192.0.2.10", "www.example.test. 300 IN A 192.0.2.12"},
+			rrsets:  []string{"www.example.test. A"},
+			sigs:    1,
+		},
+		{
+			name: "RRsets interleaved",
+			section: []string{
+				"ns.example.test. 300 IN A 192.0.2.1",
+				"ns.example.test. 300 IN AAAA 2001:db8::1",
+				"ns.example.test. 300 IN A 192.0.2.2",
+			},
+			rrsets: []string{"ns.example.test. A", "ns.example.test. AAAA"},
+			sigs:   1,
+		},
+		{
+			name:    "owner names differing in case",
+			section: []string{"WWW.example.test. 300 IN A 192.0.2.10", "www.Example.test. 300 IN A 192.0.2.12"},
+			rrsets:  []string{"www.example.test. A"},
+			sigs:    1,
+		},
+		{
+			name:    "DNSKEY signed by the KSK",
+			section: []string{zone.Keys[0].DNSKEY.String(), zone.Keys[1].DNSKEY.String()},
+			rrsets:  []string{"example.test. DNSKEY"},
+			sigs:    1,
+		},
+		{
+			name:    "out of zone",
+			section: []string{"www.example.org. 300 IN A 192.0.2.10"},
+			rrsets:  []string{"www.example.org. A"},
+			sigs:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			section := make([]dns.RR, 0, len(tt.section))
+			for _, s := range tt.section {
+				section = append(section, mustRR(t, s))
+			}
+
+			signed := server.signSection(section)
+
+			var rrsets []string
+			for i := 0; i < len(signed); {
+				hdr := signed[i].Header()
+				j := i + 1
+				for j < len(signed) && signed[j].Header().Rrtype == hdr.Rrtype && strings.EqualFold(signed[j].Header().Name, hdr.Name) {
+					j++
+				}
+
+				// Validators compare owner names in canonical form
+				rrset := make([]dns.RR, 0, j-i)
+				for _, rr := range signed[i:j] {
+					rr = dns.Copy(rr)
+					rr.Header().Name = strings.ToLower(rr.Header().Name)
+					rrset = append(rrset, rr)
+				}
+
+				sigs := 0
+				for ; j < len(signed) && signed[j].Header().Rrtype == dns.TypeRRSIG; j++ {
+					sig := signed[j].(*dns.RRSIG)
+					if err := sig.Verify(signer(t, zone, sig.KeyTag), rrset); err != nil {
+						t.Errorf("RRSIG of %s %s does not verify: %v", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+					}
+
+					if !sig.ValidityPeriod(time.Now()) {
+						t.Errorf("RRSIG of %s %s is not valid now", hdr.Name, dns.TypeToString[hdr.Rrtype])
+					}
+					sigs++
+				}
+
+				if sigs != tt.sigs {
+					t.Errorf("%s %s has %d signatures, want %d", hdr.Name, dns.TypeToString[hdr.Rrtype], sigs, tt.sigs)
+				}
+
+				rrsets = append(rrsets, strings.ToLower(hdr.Name)+" "+dns.TypeToString[hdr.Rrtype])
+				i = j
+			}
+
+			if strings.Join(rrsets, ", ") != strings.Join(tt.rrsets, ", ") {
+				t.Errorf("got RRsets %v, want %v", rrsets, tt.rrsets)
+			}
+		})
+	}
+}
+
+func TestDenyName(t *testing.T) {
+	useConfig(t, signedZone)
+	server := newTestServer(t)
+	zone := server.zoneFor(testOrigin)
+
+	tests := []struct {
+		name       string
+		encloser   string
+		nextCloser string
+	}{
+		{name: "x.example.test.", encloser: "example.test.", nextCloser: "x.example.test."},
+		{name: "y.x.example.test.", encloser: "example.test.", nextCloser: "x.example.test."},
+		{name: "x.www.example.test.", encloser: "www.example.test.", nextCloser: "x.www.example.test."},
+		{name: "c.b.example.test.", encloser: "b.example.test.", nextCloser: "c.b.example.test."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := server.denyName(zone, tt.name)
+
+			if len(records) == 0 || !records[0].(*dns.NSEC3).Match(tt.encloser) {
+				t.Fatalf("first NSEC3 does not match the closest encloser %s: %v", tt.encloser, records)
+			}
+
+			for _, covered := range []string{tt.nextCloser, "*." + tt.encloser} {
+				found := false
+				for _, rr := range records {
+					found = found || rr.(*dns.NSEC3).Cover(covered)
+				}
+
+				if !found {
+					t.Errorf("no NSEC3 covers %s: %v", covered, records)
+				}
+			}
+
+			for _, rr := range records {
+				if rr.(*dns.NSEC3).Match(tt.name) {
+					t.Errorf("NSEC3 %s matches the denied name", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestSignZoneNSEC3PARAM(t *testing.T) {
+	useConfig(t, signedZone)
+	zone := newTestServer(t).zoneFor(testOrigin)
+
+	for _, rr := range zone.Records {
+		if rr.Header().Rrtype != dns.TypeNSEC3PARAM {
+			continue
+		}
+
+		if rr.Header().Ttl != zone.SOA.Header().Ttl {
+			t.Errorf("NSEC3PARAM TTL is %d, want the SOA TTL %d", rr.Header().Ttl, zone.SOA.Header().Ttl)
+		}
+		return
+	}
+
+	t.Error("no NSEC3PARAM record in the zone")
+}
+
+// signer returns the DNSKEY of the zone with the key tag
+const nestedZone = `  dnssec:
+    enabled: true
+  zones:
+    - origin: sub.example.test
+      admin: admin.example.test
+      nameservers:
+        - name: ns.sub.example.test
+          addresses:
+            - 192.0.2.53
+`
+
+func TestNestedZoneDS(t *testing.T) {
+	useConfig(t, nestedZone)
+	server := newTestServer(t)
+	parent := server.zoneFor(testOrigin)
+	child := server.zoneFor("sub.example.test.")
+
+	r := new(dns.Msg)
+	r.SetQuestion("sub.example.test.", dns.TypeDS)
+	r.SetEdns0(4096, true)
+	m := server.respond(r)
+
+	if m.Rcode != dns.RcodeSuccess || !m.Authoritative {
+		t.Fatalf("got %s, authoritative %t", dns.RcodeToString[m.Rcode], m.Authoritative)
+	}
+
+	var rrset []dns.RR
+	var sig *dns.RRSIG
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			sig = rr
+		}
+	}
+
+	want := child.DS(dns.SHA256, time.Now())
+	if len(rrset) != len(want) || len(want) == 0 || rrset[0].String() != want[0].String() {
+		t.Fatalf("got DS %v, want %v", rrset, want)
+	}
+
+	// The DS RRset is signed by the parent, validators reach the child through it
+	if sig == nil || sig.SignerName != testOrigin {
+		t.Fatalf("DS RRset signed by %v, want %s", sig, testOrigin)
+	}
+
+	if err := sig.Verify(signer(t, parent, sig.KeyTag), rrset); err != nil {
+		t.Errorf("RRSIG of the DS RRset does not verify: %v", err)
+	}
+
+	delegation := make(map[string]bool)
+	for _, rr := range server.zoneRecords(parent) {
+		if dns.IsSubDomain(child.Origin, rr.Header().Name) {
+			delegation[strings.ToLower(rr.Header().Name)+" "+dns.TypeToString[rr.Header().Rrtype]] = true
+		}
+	}
+
+	for _, rrset := range []string{"sub.example.test. NS", "ns.sub.example.test. A", "sub.example.test. DS"} {
+		if !delegation[rrset] {
+			t.Errorf("transfer of the parent lacks %s, got %v", rrset, delegation)
+		}
+	}
+
+	if len(delegation) != 3 {
+		t.Errorf("transfer of the parent has records of the child zone %v", delegation)
+	}
+}
+
+func signer(t *testing.T, zone *Zone, tag uint16) *dns.DNSKEY {
+	t.Helper()
+
+	for _, key := range zone.Keys {
+		if key.DNSKEY.KeyTag() == tag {
+			return key.DNSKEY
+		}
+	}
+
+	t.Fatalf("no key with tag %d", tag)
+	return nil
+}
@@ -0,0 +1,482 @@
+package dns
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/global"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keyCheckInterval is how often key rollovers are scheduled and key state changes are published
+const keyCheckInterval = time.Hour
+
+// defaultPropagation is how long a key is published before it signs, and kept after it stopped signing
+const defaultPropagation = 24 * time.Hour
+
+// KeyState is the timing of a key through pre-publish rollovers, persisted next to the key files
+type KeyState struct {
+	Created  time.Time `json:"created"`
+	Publish  time.Time `json:"publish"`
+	Activate time.Time `json:"activate"`
+	Inactive time.Time `json:"inactive"`
+	Delete   time.Time `json:"delete"`
+}
+
+// Key is a DNSSEC key of a zone with its private part
+type Key struct {
+	DNSKEY *dns.DNSKEY
+	Signer crypto.Signer
+	State  KeyState
+	base   string
+}
+
+// IsKSK checks if the key is a key signing key
+func (k *Key) IsKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// Role returns KSK or ZSK
+func (k *Key) Role() string {
+	if k.IsKSK() {
+		return "KSK"
+	}
+
+	return "ZSK"
+}
+
+// Published checks if the DNSKEY is in the zone
+func (k *Key) Published(now time.Time) bool {
+	return !now.Before(k.State.Publish) && !k.Deleted(now)
+}
+
+// Active checks if the key signs the zone
+func (k *Key) Active(now time.Time) bool {
+	return !now.Before(k.State.Activate) && (k.State.Inactive.IsZero() || now.Before(k.State.Inactive)) && !k.Deleted(now)
+}
+
+// Deleted checks if the key has been removed from the zone
+func (k *Key) Deleted(now time.Time) bool {
+	return !k.State.Delete.IsZero() && !now.Before(k.State.Delete)
+}
+
+func (k *Key) saveState() error {
+	state, err := json.MarshalIndent(k.State, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(k.base+".state", state, 0600)
+}
+
+func (k *Key) remove() error {
+	var errs []error
+	for _, ext := range []string{".key", ".private", ".state"} {
+		if err := os.Remove(k.base + ext); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// keyDir is the directory of the DNSSEC keys, next to the ACME storage unless configured
+func keyDir(conf *config.Config) string {
+	if conf.DNS.DNSSEC.KeyDir != "" {
+		return conf.DNS.DNSSEC.KeyDir
+	}
+
+	return filepath.Join(conf.Providers.ACME.Storage, "dnssec")
+}
+
+// keyPropagation is the time caches need to pick up key changes
+func keyPropagation() time.Duration {
+	if config.Get().DNS.DNSSEC.Propagation > 0 {
+		return config.Get().DNS.DNSSEC.Propagation
+	}
+
+	return defaultPropagation
+}
+
+// keyAlgorithm returns the configured algorithm and its key size, ECDSAP256SHA256 by default
+func keyAlgorithm(conf *config.Config) (uint8, int, error) {
+	name := strings.ToUpper(conf.DNS.DNSSEC.Algorithm)
+	if name == "" {
+		name = dns.AlgorithmToString[dns.ECDSAP256SHA256]
+	}
+
+	switch algorithm := dns.StringToAlgorithm[name]; algorithm {
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		return algorithm, 256, nil
+	case dns.ECDSAP384SHA384:
+		return algorithm, 384, nil
+	case dns.RSASHA256, dns.RSASHA512:
+		return algorithm, 2048, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported DNSSEC algorithm %s", conf.DNS.DNSSEC.Algorithm)
+	}
+}
+
+// loadKeys reads the keys of a zone in BIND format, removes the keys past their deletion
+// and generates a KSK and ZSK when the zone has none
+func loadKeys(origin string, conf *config.Config, now time.Time) ([]*Key, error) {
+	dir := keyDir(conf)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "K"+origin+"+*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, 0, 2)
+	for _, file := range files {
+		key, err := readKey(strings.TrimSuffix(file, ".key"), now)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read DNSSEC key %s: %w", file, err)
+		}
+
+		if key.Deleted(now) {
+			if err = key.remove(); err != nil {
+				return nil, err
+			}
+
+			journal.Logger.Sugar().With("Zone", origin, "KeyTag", key.DNSKEY.KeyTag(), "Role", key.Role()).Info("Removed retired DNSSEC key")
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	for _, flags := range []uint16{dns.ZONE | dns.SEP, dns.ZONE} {
+		exists := false
+		for _, key := range keys {
+			exists = exists || key.DNSKEY.Flags == flags
+		}
+
+		if exists {
+			continue
+		}
+
+		key, err := generateKey(origin, conf, flags, now, now)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// readKey reads the public and private key files sharing the base name with their state.
+// Keys without state, e.g. imported from BIND, are published and active from now on.
+func readKey(base string, now time.Time) (*Key, error) {
+	public, err := os.ReadFile(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+
+	rr, err := dns.NewRR(string(public))
+	if err != nil {
+		return nil, err
+	}
+
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("not a DNSKEY record")
+	}
+
+	file, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	private, err := dnskey.ReadPrivateKey(file, base+".private")
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key")
+	}
+
+	key := &Key{DNSKEY: dnskey, Signer: signer, base: base}
+
+	state, err := os.ReadFile(base + ".state")
+	if os.IsNotExist(err) {
+		key.State = KeyState{Created: now, Publish: now, Activate: now}
+		return key, key.saveState()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, json.Unmarshal(state, &key.State)
+}
+
+// generateKey creates a key and writes it to the key directory in BIND format
+func generateKey(origin string, conf *config.Config, flags uint16, publish, activate time.Time) (*Key, error) {
+	algorithm, bits, err := keyAlgorithm(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   origin,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTTL,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+
+	private, err := dnskey.Generate(bits)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		DNSKEY: dnskey,
+		Signer: private.(crypto.Signer),
+		State:  KeyState{Created: time.Now(), Publish: publish, Activate: activate},
+		base:   filepath.Join(keyDir(conf), fmt.Sprintf("K%s+%03d+%05d", origin, algorithm, dnskey.KeyTag())),
+	}
+
+	if err = os.WriteFile(key.base+".private", []byte(dnskey.PrivateKeyString(private)), 0600); err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(key.base+".key", []byte(dnskey.String()+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	if err = key.saveState(); err != nil {
+		return nil, err
+	}
+
+	journal.Logger.Sugar().With("Zone", origin, "KeyTag", dnskey.KeyTag(), "Role", key.Role()).Info("Generated DNSSEC key")
+
+	return key, nil
+}
+
+// currentKey returns the most recently activated key of the role
+func (z *Zone) currentKey(ksk bool, now time.Time) *Key {
+	var current *Key
+	for _, key := range z.Keys {
+		if key.IsKSK() == ksk && key.Active(now) && (current == nil || key.State.Activate.After(current.State.Activate)) {
+			current = key
+		}
+	}
+
+	return current
+}
+
+// rolling checks if a rollover of the role is in progress: a successor is published but not yet active,
+// or a new KSK is active while the old one waits for the DS record at the parent zone to be replaced
+func (z *Zone) rolling(ksk bool, now time.Time) bool {
+	retained := 0
+	for _, key := range z.Keys {
+		if key.IsKSK() != ksk {
+			continue
+		}
+
+		if key.State.Activate.After(now) {
+			return true
+		}
+
+		if key.State.Inactive.IsZero() && !key.Deleted(now) {
+			retained++
+		}
+	}
+
+	return ksk && retained > 1
+}
+
+// Rollover starts a pre-publish rollover: the successor is published now and activated once caches have seen it.
+// A ZSK stops signing at that moment and is removed after another propagation. A KSK keeps signing the DNSKEY
+// RRset until CompleteRollover confirms that the DS record at the parent zone has been replaced.
+func (z *Zone) Rollover(ksk bool, now time.Time) (*Key, error) {
+	if len(z.Keys) == 0 {
+		return nil, fmt.Errorf("zone %s is not signed", z.Origin)
+	}
+
+	if z.rolling(ksk, now) {
+		return nil, fmt.Errorf("a rollover is already in progress")
+	}
+
+	flags := uint16(dns.ZONE)
+	if ksk {
+		flags |= dns.SEP
+	}
+
+	propagation := keyPropagation()
+	current := z.currentKey(ksk, now)
+
+	successor, err := generateKey(z.Origin, config.Get(), flags, now, now.Add(propagation))
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && !ksk {
+		current.State.Inactive = successor.State.Activate
+		current.State.Delete = successor.State.Activate.Add(propagation)
+		if err = current.saveState(); err != nil {
+			return nil, err
+		}
+	}
+
+	z.Keys = append(z.Keys, successor)
+
+	return successor, nil
+}
+
+// CompleteRollover retires the old KSKs once the DS record of the new KSK is published at the parent zone.
+// They keep signing the DNSKEY RRset until they are removed after a propagation, while the old DS expires from caches.
+func (z *Zone) CompleteRollover(now time.Time) ([]*Key, error) {
+	successor := z.currentKey(true, now)
+	if successor == nil || !z.rolling(true, now) {
+		return nil, fmt.Errorf("no KSK rollover in progress")
+	}
+
+	for _, key := range z.Keys {
+		if key.IsKSK() && key.State.Activate.After(now) {
+			return nil, fmt.Errorf("the new KSK %d is not active before %s", key.DNSKEY.KeyTag(), key.State.Activate.Format(time.RFC3339))
+		}
+	}
+
+	retired := make([]*Key, 0, 1)
+	for _, key := range z.Keys {
+		if !key.IsKSK() || key == successor || !key.State.Inactive.IsZero() || key.Deleted(now) {
+			continue
+		}
+
+		key.State.Inactive = now.Add(keyPropagation())
+		key.State.Delete = key.State.Inactive
+		if err := key.saveState(); err != nil {
+			return retired, err
+		}
+
+		retired = append(retired, key)
+	}
+
+	return retired, nil
+}
+
+// overdue checks if the current key of the role exceeded its lifetime without a rollover in progress
+func (z *Zone) overdue(ksk bool, now time.Time) bool {
+	lifetime := config.Get().DNS.DNSSEC.ZSKLifetime
+	if ksk {
+		lifetime = config.Get().DNS.DNSSEC.KSKLifetime
+	}
+
+	current := z.currentKey(ksk, now)
+
+	return lifetime > 0 && current != nil && !z.rolling(ksk, now) && now.Sub(current.State.Activate) >= lifetime
+}
+
+// KSKOverdue checks if the KSK exceeded its lifetime, KSK rollovers are only started by the operator
+// because the DS record at the parent zone has to be replaced
+func (z *Zone) KSKOverdue(now time.Time) bool {
+	return z.overdue(true, now)
+}
+
+// ScheduledRollover starts the rollover of the ZSK when it exceeded its lifetime, nil when none is due
+func (z *Zone) ScheduledRollover(now time.Time) (*Key, error) {
+	if !z.overdue(false, now) {
+		return nil, nil
+	}
+
+	return z.Rollover(false, now)
+}
+
+// stateChanged checks if a key was published, activated, deactivated or deleted after since, up to now
+func (z *Zone) stateChanged(since, now time.Time) bool {
+	for _, key := range z.Keys {
+		for _, t := range []time.Time{key.State.Publish, key.State.Activate, key.State.Inactive, key.State.Delete} {
+			if t.After(since) && !t.After(now) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DS returns the DS records of the published KSKs for the parent zone
+func (z *Zone) DS(digest uint8, now time.Time) []*dns.DS {
+	records := make([]*dns.DS, 0, 1)
+	for _, key := range z.Keys {
+		if key.IsKSK() && key.Published(now) {
+			records = append(records, key.DNSKEY.ToDS(digest))
+		}
+	}
+
+	return records
+}
+
+// manageKeys performs the scheduled ZSK rollovers and publishes the key state changes until shutdown.
+// Zones are only rebuilt when a key state changed, every rebuild bumps the serials and notifies the secondaries.
+func manageKeys() {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-global.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		zones, err := LoadZones(config.Get())
+		if err != nil {
+			journal.Logger.Sugar().With("Error", err.Error()).Error("Unable to load zones for DNSSEC key rollover")
+			continue
+		}
+
+		changed := false
+		for _, zone := range zones {
+			successor, err := zone.ScheduledRollover(now)
+			if err != nil {
+				journal.Logger.Sugar().With("Zone", zone.Origin, "Error", err.Error()).Error("Unable to roll over DNSSEC key")
+			}
+
+			if successor != nil {
+				journal.Logger.Sugar().With("Zone", zone.Origin, "KeyTag", successor.DNSKEY.KeyTag(), "Activate", successor.State.Activate).Info("Started ZSK rollover")
+				changed = true
+			}
+
+			if zone.KSKOverdue(now) {
+				journal.Logger.Sugar().With("Zone", zone.Origin).Warn("The KSK exceeded its lifetime, start a rollover with cdns dnssec rollover --ksk")
+			}
+
+			// Keys created or retired by the dnssec command are picked up here as well
+			changed = changed || zone.stateChanged(last, now)
+		}
+		last = now
+
+		if !changed {
+			continue
+		}
+
+		if _, err = refreshZones(config.Get()); err != nil {
+			journal.Logger.Sugar().With("Error", err.Error()).Error("Unable to refresh zones after DNSSEC key state change")
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package dns
+
+import (
+	"github.com/betterde/cdns/config"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+const rolledZone = `  dnssec:
+    enabled: true
+    propagation: 1h
+    kskLifetime: 8760h
+    zskLifetime: 720h
+`
+
+// loadSignedZone loads the zone of the test configuration with a fresh KSK and ZSK
+func loadSignedZone(t *testing.T) *Zone {
+	t.Helper()
+
+	useConfig(t, rolledZone)
+	zones, err := LoadZones(config.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return zones[0]
+}
+
+func TestRollover(t *testing.T) {
+	tests := []struct {
+		name string
+		ksk  bool
+		// inactive and delete are the times of the old key relative to the start of the rollover, zero when unset
+		inactive time.Duration
+		delete   time.Duration
+	}{
+		{name: "ZSK", ksk: false, inactive: time.Hour, delete: 2 * time.Hour},
+		{name: "KSK", ksk: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone := loadSignedZone(t)
+			now := time.Now().Add(24 * time.Hour)
+			old := zone.currentKey(tt.ksk, now)
+
+			successor, err := zone.Rollover(tt.ksk, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if successor.IsKSK() != tt.ksk || !successor.State.Publish.Equal(now) || !successor.State.Activate.Equal(now.Add(time.Hour)) {
+				t.Errorf("successor %s published at %s and active at %s, want %s and an hour later", successor.Role(), successor.State.Publish, successor.State.Activate, now)
+			}
+
+			for _, state := range []struct {
+				label string
+				got   time.Time
+				want  time.Duration
+			}{
+				{"inactive", old.State.Inactive, tt.inactive},
+				{"delete", old.State.Delete, tt.delete},
+			} {
+				if (state.want == 0 && !state.got.IsZero()) || (state.want != 0 && !state.got.Equal(now.Add(state.want))) {
+					t.Errorf("old key %s at %s, want %s after the start of the rollover", state.label, state.got, state.want)
+				}
+			}
+
+			if _, err = zone.Rollover(tt.ksk, now.Add(time.Minute)); err == nil {
+				t.Error("second rollover started while the first one is in progress")
+			}
+
+			// The old KSK keeps signing the DNSKEY RRset after the new one is active
+			later := now.Add(3 * time.Hour)
+			if tt.ksk {
+				if signing := zone.signingKeys(dns.TypeDNSKEY, later); len(signing) != 2 {
+					t.Errorf("%d KSKs sign the DNSKEY RRset, want 2", len(signing))
+				}
+
+				if _, err = zone.Rollover(true, later); err == nil {
+					t.Error("KSK rollover started before the previous one was completed")
+				}
+			} else if old.Published(later) {
+				t.Error("old ZSK still published after its deletion")
+			}
+		})
+	}
+}
+
+func TestCompleteRollover(t *testing.T) {
+	zone := loadSignedZone(t)
+	now := time.Now().Add(24 * time.Hour)
+
+	if _, err := zone.CompleteRollover(now); err == nil {
+		t.Fatal("rollover completed without a rollover in progress")
+	}
+
+	old := zone.currentKey(true, now)
+	successor, err := zone.Rollover(true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = zone.CompleteRollover(now.Add(time.Minute)); err == nil {
+		t.Fatal("rollover completed before the new KSK is active")
+	}
+
+	done := now.Add(2 * time.Hour)
+	retired, err := zone.CompleteRollover(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(retired) != 1 || retired[0] != old {
+		t.Fatalf("retired %d keys, want the old KSK", len(retired))
+	}
+
+	if want := done.Add(time.Hour); !old.State.Inactive.Equal(want) || !old.State.Delete.Equal(want) {
+		t.Errorf("old KSK inactive at %s and deleted at %s, want both at %s", old.State.Inactive, old.State.Delete, want)
+	}
+
+	if !successor.State.Inactive.IsZero() || !successor.State.Delete.IsZero() {
+		t.Error("the new KSK is retired")
+	}
+
+	if zone.rolling(true, done) {
+		t.Error("KSK rollover still in progress after completion")
+	}
+
+	if _, err = zone.CompleteRollover(done); err == nil {
+		t.Error("rollover completed twice")
+	}
+}
+
+func TestScheduledRollover(t *testing.T) {
+	tests := []struct {
+		name       string
+		age        time.Duration
+		rolled     bool
+		kskOverdue bool
+	}{
+		{name: "keys within their lifetime", age: 24 * time.Hour},
+		{name: "ZSK due", age: 720 * time.Hour, rolled: true},
+		{name: "ZSK and KSK due", age: 8760 * time.Hour, rolled: true, kskOverdue: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone := loadSignedZone(t)
+			now := time.Now().Add(tt.age)
+
+			successor, err := zone.ScheduledRollover(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (successor != nil) != tt.rolled {
+				t.Errorf("rollover started: %t, want %t", successor != nil, tt.rolled)
+			}
+
+			if successor != nil && successor.IsKSK() {
+				t.Error("KSK rollover started automatically")
+			}
+
+			if zone.KSKOverdue(now) != tt.kskOverdue {
+				t.Errorf("KSK overdue: %t, want %t", zone.KSKOverdue(now), tt.kskOverdue)
+			}
+		})
+	}
+}
+
+func TestStateChanged(t *testing.T) {
+	zone := loadSignedZone(t)
+	now := time.Now().Add(24 * time.Hour)
+	if _, err := zone.Rollover(false, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		since   time.Time
+		until   time.Time
+		changed bool
+	}{
+		{name: "successor published", since: now.Add(-time.Hour), until: now, changed: true},
+		{name: "nothing due", since: now, until: now.Add(30 * time.Minute)},
+		{name: "successor activated", since: now.Add(30 * time.Minute), until: now.Add(time.Hour), changed: true},
+		{name: "old key deleted", since: now.Add(90 * time.Minute), until: now.Add(2 * time.Hour), changed: true},
+		{name: "after the rollover", since: now.Add(2 * time.Hour), until: now.Add(3 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if changed := zone.stateChanged(tt.since, tt.until); changed != tt.changed {
+				t.Errorf("state changed: %t, want %t", changed, tt.changed)
+			}
+		})
+	}
+}
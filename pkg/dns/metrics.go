@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"github.com/betterde/cdns/internal/metrics"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// recorder keeps the first response written for a request
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	if r.msg == nil {
+		r.msg = m
+	}
+
+	return r.ResponseWriter.WriteMsg(m)
+}
+
+// transport returns the protocol label of a listener protocol
+func transport(protocol string) string {
+	switch {
+	case protocol == "quic":
+		return "quic"
+	case strings.HasSuffix(protocol, "-tls"):
+		return "tls"
+	case strings.HasPrefix(protocol, "tcp"):
+		return "tcp"
+	default:
+		return "udp"
+	}
+}
+
+// instrument returns the request handler of a listener, recording the metrics of every request
+func (d *Server) instrument(protocol string) dns.HandlerFunc {
+	protocol = transport(protocol)
+
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		start := time.Now()
+		rec := &recorder{ResponseWriter: w}
+		d.handleRequest(rec, r)
+		d.observe(protocol, w.RemoteAddr(), r, rec.msg, start)
+	}
+}
+
+// observe records the latency of a request, and the request itself once it got a response
+func (d *Server) observe(protocol string, remote net.Addr, r, m *dns.Msg, start time.Time) {
+	metrics.QueryDuration.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+	queries.log(protocol, remote, r, m, start)
+
+	if m == nil || len(r.Question) == 0 {
+		return
+	}
+
+	// Unknown types are folded so that clients cannot create a series per type number
+	q := r.Question[0]
+	qtype, ok := dns.TypeToString[q.Qtype]
+	if !ok {
+		qtype = "OTHER"
+	}
+
+	var zone string
+	d.RLock()
+	if z := d.zoneFor(q.Name); z != nil {
+		zone = z.Origin
+	}
+	d.RUnlock()
+
+	metrics.Queries.WithLabelValues(qtype, dns.RcodeToString[m.Rcode], protocol, zone).Inc()
+}
+
+// txtRecords returns the number of TXT records served
+func (d *Server) txtRecords() float64 {
+	d.RLock()
+	defer d.RUnlock()
+
+	var count int
+	for _, domain := range d.Domains {
+		for _, rr := range domain.Records {
+			if rr.Header().Rrtype == dns.TypeTXT {
+				count++
+			}
+		}
+	}
+
+	return float64(count)
+}
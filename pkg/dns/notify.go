@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"context"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/global"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// notifyTimeout is how long to wait for a secondary to acknowledge a NOTIFY
+	notifyTimeout = 5 * time.Second
+	// notifyMaxInterval caps the backoff between NOTIFY retries
+	notifyMaxInterval = 5 * time.Minute
+)
+
+// notifications tracks the pending NOTIFY of every zone and secondary, a newer serial supersedes the pending one
+var notifications = struct {
+	pending map[string]context.CancelFunc
+	sync.Mutex
+}{pending: make(map[string]context.CancelFunc)}
+
+// notifySecondaries tells the configured secondaries that the zone changed (RFC 1996), retrying until they acknowledge it
+func notifySecondaries(soa dns.RR) {
+	notifications.Lock()
+	defer notifications.Unlock()
+
+	for _, secondary := range config.Get().DNS.Transfer.Notify {
+		addr := secondary
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+
+		key := soa.Header().Name + " " + addr
+		if cancel, ok := notifications.pending[key]; ok {
+			cancel()
+		}
+
+		ctx, cancel := context.WithCancel(global.Ctx)
+		notifications.pending[key] = cancel
+
+		go func() {
+			defer func() {
+				notifications.Lock()
+				defer notifications.Unlock()
+
+				// Only forget the notification if it has not been superseded meanwhile
+				if ctx.Err() == nil {
+					delete(notifications.pending, key)
+				}
+				cancel()
+			}()
+
+			notify(ctx, addr, soa)
+		}()
+	}
+}
+
+// notify sends a NOTIFY for the zone of the SOA with exponential backoff until acknowledged or cancelled
+func notify(ctx context.Context, addr string, soa dns.RR) {
+	client := &dns.Client{Net: "udp", Timeout: notifyTimeout, TsigProvider: tsigProvider{}}
+	logger := journal.Logger.Sugar().With("Zone", soa.Header().Name, "Serial", soa.(*dns.SOA).Serial, "Secondary", addr)
+
+	interval := time.Second
+	for attempt := 1; ; attempt++ {
+		m := new(dns.Msg)
+		m.SetNotify(soa.Header().Name)
+		m.Answer = []dns.RR{soa}
+		if keys := config.Get().DNS.Transfer.Keys; len(keys) > 0 {
+			if key := tsigKey(keys[0]); key != nil {
+				m.SetTsig(dns.CanonicalName(key.Name), tsigAlgorithm(key), 300, time.Now().Unix())
+			}
+		}
+
+		r, _, err := client.ExchangeContext(ctx, m, addr)
+		if err == nil && r.Opcode == dns.OpcodeNotify && r.Rcode == dns.RcodeSuccess {
+			logger.With("Attempts", attempt).Debug("Secondary acknowledged NOTIFY")
+			return
+		}
+
+		failure := logger.With("Attempt", attempt, "Retry", interval)
+		if err == nil {
+			failure = failure.With("RCode", dns.RcodeToString[r.Rcode])
+		} else {
+			failure = failure.With("Error", err.Error())
+		}
+		failure.Warn("Secondary did not acknowledge NOTIFY")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		interval = min(interval*2, notifyMaxInterval)
+	}
+}
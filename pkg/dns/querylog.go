@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"errors"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// socketProtocols maps the protocol labels to dnstap, DOQ is not part of the generated enum yet
+var socketProtocols = map[string]dnstap.SocketProtocol{
+	"udp":   dnstap.SocketProtocol_UDP,
+	"tcp":   dnstap.SocketProtocol_TCP,
+	"tls":   dnstap.SocketProtocol_DOT,
+	"https": dnstap.SocketProtocol_DOH,
+	"quic":  dnstap.SocketProtocol(7),
+}
+
+// queries is the query log, nil when no output is configured
+var queries *queryLog
+
+// queryLog writes every answered request as a JSON line and as dnstap frames, independent of the log level
+type queryLog struct {
+	json     *zap.Logger
+	file     *os.File
+	dnstap   dnstap.Output
+	identity string
+	closed   bool
+	sync.RWMutex
+}
+
+// newQueryLog opens the outputs of the query log, nil when none is configured
+func newQueryLog(conf config.QueryLog) (*queryLog, error) {
+	if conf.JSON == "" && conf.Dnstap == "" {
+		return nil, nil
+	}
+
+	l := &queryLog{}
+	l.identity, _ = os.Hostname()
+
+	if conf.JSON != "" {
+		l.file = os.Stdout
+		if conf.JSON != "stdout" {
+			file, err := os.OpenFile(conf.JSON, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			l.file = file
+		}
+
+		encoderConfig := zapcore.EncoderConfig{
+			TimeKey:        "ts",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+		}
+
+		l.json = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.Lock(l.file), zapcore.DebugLevel))
+	}
+
+	if conf.Dnstap != "" {
+		if socket, ok := strings.CutPrefix(conf.Dnstap, "unix://"); ok {
+			output, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: socket, Net: "unix"})
+			if err != nil {
+				return nil, errors.Join(err, l.close())
+			}
+			l.dnstap = output
+		} else {
+			output, err := dnstap.NewFrameStreamOutputFromFilename(conf.Dnstap)
+			if err != nil {
+				return nil, errors.Join(err, l.close())
+			}
+			l.dnstap = output
+		}
+
+		go l.dnstap.RunOutputLoop()
+	}
+
+	return l, nil
+}
+
+// log records a request and its response
+func (l *queryLog) log(protocol string, remote net.Addr, r, m *dns.Msg, start time.Time) {
+	if l == nil || m == nil || len(r.Question) == 0 {
+		return
+	}
+
+	// Requests over HTTP may still be answered while the listeners are shut down
+	l.RLock()
+	defer l.RUnlock()
+	if l.closed {
+		return
+	}
+
+	var ip net.IP
+	var port int
+	if host, p, err := net.SplitHostPort(remote.String()); err == nil {
+		ip = net.ParseIP(host)
+		port, _ = strconv.Atoi(p)
+	}
+
+	if l.json != nil {
+		q := r.Question[0]
+		l.json.Info("",
+			zap.Stringer("Remote", ip),
+			zap.String("Proto", protocol),
+			zap.String("Domain", q.Name),
+			zap.String("QType", dns.Type(q.Qtype).String()),
+			zap.String("RCode", dns.RcodeToString[m.Rcode]),
+			zap.Duration("Latency", time.Since(start)),
+			zap.Int("Answers", len(m.Answer)),
+		)
+	}
+
+	if l.dnstap != nil {
+		l.tap(protocol, ip, port, r, m, start)
+	}
+}
+
+// tap sends the request and the response as dnstap AUTH_QUERY and AUTH_RESPONSE messages.
+// Frames are dropped when the output is not keeping up, the answers are never held back by the query log.
+func (l *queryLog) tap(protocol string, ip net.IP, port int, r, m *dns.Msg, start time.Time) {
+	query, err := r.Pack()
+	if err != nil {
+		return
+	}
+
+	response, err := m.Pack()
+	if err != nil {
+		return
+	}
+
+	family := dnstap.SocketFamily_INET6
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip = dnstap.SocketFamily_INET, ip4
+	}
+
+	end := time.Now()
+	messages := []*dnstap.Message{
+		{
+			Type:          dnstap.Message_AUTH_QUERY.Enum(),
+			QueryTimeSec:  proto.Uint64(uint64(start.Unix())),
+			QueryTimeNsec: proto.Uint32(uint32(start.Nanosecond())),
+			QueryMessage:  query,
+		},
+		{
+			Type:             dnstap.Message_AUTH_RESPONSE.Enum(),
+			QueryTimeSec:     proto.Uint64(uint64(start.Unix())),
+			QueryTimeNsec:    proto.Uint32(uint32(start.Nanosecond())),
+			ResponseTimeSec:  proto.Uint64(uint64(end.Unix())),
+			ResponseTimeNsec: proto.Uint32(uint32(end.Nanosecond())),
+			ResponseMessage:  response,
+		},
+	}
+
+	for _, message := range messages {
+		message.SocketFamily = family.Enum()
+		message.SocketProtocol = socketProtocols[protocol].Enum()
+		if ip != nil {
+			message.QueryAddress = ip
+			message.QueryPort = proto.Uint32(uint32(port))
+		}
+
+		frame, err := proto.Marshal(&dnstap.Dnstap{
+			Type:     dnstap.Dnstap_MESSAGE.Enum(),
+			Identity: []byte(l.identity),
+			Version:  []byte("cdns"),
+			Message:  message,
+		})
+		if err != nil {
+			journal.Logger.Sugar().With("Error", err.Error()).Error("Unable to encode dnstap message")
+			return
+		}
+
+		select {
+		case l.dnstap.GetOutputChannel() <- frame:
+		default:
+		}
+	}
+}
+
+// close flushes and closes the outputs
+func (l *queryLog) close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+
+	if l.dnstap != nil {
+		l.dnstap.Close()
+	}
+
+	if l.json != nil {
+		_ = l.json.Sync()
+	}
+
+	if l.file != nil && l.file != os.Stdout {
+		return l.file.Close()
+	}
+
+	return nil
+}
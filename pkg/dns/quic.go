@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"time"
+)
+
+// Error codes of DNS-over-QUIC connections (RFC 9250 section 4.3)
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// quicReadTimeout limits how long a client may take to send its query on a stream
+const quicReadTimeout = 2 * time.Second
+
+// startQUIC serves the records on a DNS-over-QUIC (RFC 9250) listener until it is shut down
+func (d *Server) startQUIC(listener config.Listener, tlsConf *tls.Config, errorChannel chan error) {
+	ln, err := quic.ListenAddr(listener.Listen, tlsConf, &quic.Config{})
+	if err != nil {
+		errorChannel <- err
+		return
+	}
+
+	d.Lock()
+	d.quicListeners = append(d.quicListeners, ln)
+	d.Unlock()
+
+	journal.Logger.Sugar().With("Addr", listener.Listen, "Proto", listener.Protocol).Debug("Listening DNS")
+
+	handler := d.instrument(listener.Protocol)
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				errorChannel <- err
+			}
+			return
+		}
+
+		go serveQUIC(conn, handler)
+	}
+}
+
+// serveQUIC answers the queries of a connection, every query has a stream of its own
+func serveQUIC(conn quic.Connection, handler dns.HandlerFunc) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go serveStream(conn, stream, handler)
+	}
+}
+
+// serveStream answers the query of a stream, malformed queries close the connection with a protocol error
+func serveStream(conn quic.Connection, stream quic.Stream, handler dns.HandlerFunc) {
+	_ = stream.SetReadDeadline(time.Now().Add(quicReadTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		_ = conn.CloseWithError(doqProtocolError, "")
+		return
+	}
+
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(stream, raw); err != nil {
+		_ = conn.CloseWithError(doqProtocolError, "")
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(raw); err != nil || r.Id != 0 || r.Response || len(r.Question) != 1 {
+		_ = conn.CloseWithError(doqProtocolError, "")
+		return
+	}
+
+	w := &quicWriter{conn: conn, stream: stream}
+	if tsig := r.IsTsig(); tsig != nil {
+		w.tsigStatus = dns.TsigVerifyWithProvider(raw, tsigProvider{}, "", false)
+		w.tsigRequestMAC = tsig.MAC
+	}
+
+	handler(w, r)
+
+	if err := stream.Close(); err != nil {
+		_ = conn.CloseWithError(doqInternalError, "")
+	}
+}
+
+// quicAddr is the local address of a DNS-over-QUIC listener. It does not report the "udp" network,
+// answers are not truncated and zone transfers are allowed like over TCP.
+type quicAddr struct {
+	net.Addr
+}
+
+func (quicAddr) Network() string {
+	return "quic"
+}
+
+// quicWriter writes the responses to a stream, prefixed with their length like over TCP
+type quicWriter struct {
+	conn           quic.Connection
+	stream         quic.Stream
+	tsigStatus     error
+	tsigTimersOnly bool
+	tsigRequestMAC string
+}
+
+func (w *quicWriter) LocalAddr() net.Addr {
+	return quicAddr{w.conn.LocalAddr()}
+}
+
+func (w *quicWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *quicWriter) WriteMsg(m *dns.Msg) error {
+	var data []byte
+	var err error
+	if m.IsTsig() != nil {
+		data, w.tsigRequestMAC, err = dns.TsigGenerateWithProvider(m, tsigProvider{}, w.tsigRequestMAC, w.tsigTimersOnly)
+	} else {
+		data, err = m.Pack()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+func (w *quicWriter) Write(data []byte) (int, error) {
+	if len(data) > dns.MaxMsgSize {
+		return 0, dns.ErrBuf
+	}
+
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	n, err := w.stream.Write(append(buf, data...))
+
+	return max(n-2, 0), err
+}
+
+func (w *quicWriter) Close() error {
+	return w.conn.CloseWithError(doqNoError, "")
+}
+
+func (w *quicWriter) TsigStatus() error {
+	return w.tsigStatus
+}
+
+func (w *quicWriter) TsigTimersOnly(timersOnly bool) {
+	w.tsigTimersOnly = timersOnly
+}
+
+func (w *quicWriter) Hijack() {}
@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Manages checks if name is a domain name inside one of the served zones or the HTTP domain.
+// Records created through the API must pass it, other names could not be loaded again after a restart.
+func Manages(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == "." {
+		return false
+	}
+
+	ServerInstance.RLock()
+	defer ServerInstance.RUnlock()
+
+	return ServerInstance.zoneFor(name) != nil || dns.IsSubDomain(ServerInstance.Domain, name)
+}
+
+// AppendRecord writes the record through to the store and adds it to the server
+func AppendRecord(rr dns.RR) error {
+	rr.Header().Name = strings.ToLower(dns.Fqdn(rr.Header().Name))
+
+	ServerInstance.Lock()
+	defer ServerInstance.Unlock()
+
+	if err := ServerInstance.appendRecord(rr); err != nil {
+		return err
+	}
+
+	ServerInstance.commit(rr.Header().Name, nil, []dns.RR{rr})
+
+	return nil
+}
+
+// RemoveTXTRecord deletes the dynamic TXT records of name whose value matches from the store and the server
+func RemoveTXTRecord(name, value string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	ServerInstance.Lock()
+	defer ServerInstance.Unlock()
+
+	// Records of the configuration and zone files are only changed there
+	var removed []dns.RR
+	for _, rr := range ServerInstance.Domains[name].Records {
+		if _, static := ServerInstance.static[rr]; static {
+			continue
+		}
+
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			removed = append(removed, rr)
+		}
+	}
+
+	for _, rr := range removed {
+		if err := ServerInstance.removeRecord(rr); err != nil {
+			return err
+		}
+	}
+
+	ServerInstance.commit(name, removed, nil)
+
+	return nil
+}
+
+// RotateTXTRecord adds the TXT record and removes the oldest dynamic TXT records of its name so that at most limit remain,
+// reading and changing the records under a single lock
+func RotateTXTRecord(rr *dns.TXT, limit int) error {
+	name := strings.ToLower(dns.Fqdn(rr.Hdr.Name))
+	rr.Hdr.Name = name
+
+	ServerInstance.Lock()
+	defer ServerInstance.Unlock()
+
+	// The records are kept in the order they were added, also across restarts
+	var existing []dns.RR
+	for _, record := range ServerInstance.Domains[name].Records {
+		if _, static := ServerInstance.static[record]; !static && record.Header().Rrtype == dns.TypeTXT {
+			existing = append(existing, record)
+		}
+	}
+
+	var removed []dns.RR
+	for len(existing) >= limit && len(existing) > 0 {
+		if err := ServerInstance.removeRecord(existing[0]); err != nil {
+			ServerInstance.commit(name, removed, nil)
+			return err
+		}
+		removed = append(removed, existing[0])
+		existing = existing[1:]
+	}
+
+	if err := ServerInstance.appendRecord(rr); err != nil {
+		ServerInstance.commit(name, removed, nil)
+		return err
+	}
+
+	ServerInstance.commit(name, removed, []dns.RR{rr})
+
+	return nil
+}
+
+// appendRecord persists the record and adds it to the server, the caller holds the lock
+func (d *Server) appendRecord(rr dns.RR) error {
+	if err := Store.Append(rr); err != nil {
+		return err
+	}
+
+	d.appendRR(rr)
+
+	return nil
+}
+
+// removeRecord deletes the record from the store and the server, the caller holds the lock
+func (d *Server) removeRecord(rr dns.RR) error {
+	if err := Store.Remove(rr); err != nil {
+		return err
+	}
+
+	name := rr.Header().Name
+	domain := d.Domains[name]
+	result := make([]dns.RR, 0, len(domain.Records))
+	for _, existing := range domain.Records {
+		if existing != rr {
+			result = append(result, existing)
+		}
+	}
+
+	if len(result) < len(domain.Records) {
+		d.countName(name, len(result)-len(domain.Records))
+	}
+
+	if len(result) == 0 {
+		delete(d.Domains, name)
+	} else {
+		d.Domains[name] = Records{Records: result}
+	}
+
+	return nil
+}
+
+// commit records a change of the dynamic records of name in the zone containing it, the caller holds the lock
+func (d *Server) commit(name string, deleted, added []dns.RR) {
+	if zone := d.zoneFor(name); zone != nil && zone.commit(deleted, added) {
+		notifySecondaries(dns.Copy(zone.SOA))
+	}
+}
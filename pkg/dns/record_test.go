@@ -0,0 +1,34 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManages(t *testing.T) {
+	useConfig(t, "")
+	ServerInstance = newTestServer(t)
+
+	tests := []struct {
+		name    string
+		fqdn    string
+		manages bool
+	}{
+		{name: "challenge in zone", fqdn: "_acme-challenge.www.example.test.", manages: true},
+		{name: "without trailing dot", fqdn: "_acme-challenge.example.test", manages: true},
+		{name: "mixed case", fqdn: "_ACME-challenge.Example.Test.", manages: true},
+		{name: "empty", fqdn: ""},
+		{name: "root", fqdn: "."},
+		{name: "empty label", fqdn: "a..example.test."},
+		{name: "label too long", fqdn: strings.Repeat("a", 64) + ".example.test."},
+		{name: "out of zone", fqdn: "_acme-challenge.example.org."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if manages := Manages(tt.fqdn); manages != tt.manages {
+				t.Errorf("got %t, want %t", manages, tt.manages)
+			}
+		})
+	}
+}
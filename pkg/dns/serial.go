@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/pkg/store"
+	"github.com/miekg/dns"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Serials hands out the SOA serials of every zone, shared by all listeners so that they never disagree
+var Serials *SerialManager
+
+// SerialManager keeps the SOA serials monotonic across changes, reloads and restarts by persisting the last one
+type SerialManager struct {
+	store store.SerialStore
+	sync.Mutex
+}
+
+func NewSerialManager(store store.SerialStore) *SerialManager {
+	return &SerialManager{store: store}
+}
+
+// Next returns a serial newer than the last one of the zone, at least floor and the serial of the configured scheme now.
+// The serial is persisted before it is returned.
+func (s *SerialManager) Next(zone string, floor uint32) (uint32, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	last, err := s.store.Serial(zone)
+	if err != nil {
+		return 0, err
+	}
+
+	next := max(last+1, floor, baseSerial(time.Now()))
+	if err = s.store.SaveSerial(zone, next); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// serialStore returns where the serials are persisted, the memory store forgets them on restart so they are kept
+// in a state file in the ACME storage, next to the certificates and the default DNSSEC key directory
+func serialStore(s store.Store) (store.SerialStore, error) {
+	if _, ok := s.(*store.MemoryStore); !ok {
+		return s, nil
+	}
+
+	return store.NewSerialFile(filepath.Join(config.Get().Providers.ACME.Storage, "serials.json"))
+}
+
+// baseSerial is the lowest serial of the configured scheme at the time, YYYYMMDDnn by default
+func baseSerial(now time.Time) uint32 {
+	if config.Get().DNS.Serial == config.SerialSchemeUnixtime {
+		return uint32(now.Unix())
+	}
+
+	value, _ := strconv.ParseUint(now.Format("20060102")+"00", 10, 32)
+	return uint32(value)
+}
+
+// assignSerials gives every loaded zone a serial newer than the one it was last served with
+func assignSerials(zones []*Zone) {
+	for _, zone := range zones {
+		if soa, ok := zone.SOA.(*dns.SOA); ok {
+			soa.Serial = nextSerial(zone.Origin, soa.Serial)
+		}
+	}
+}
+
+// nextSerial returns the next serial of a zone, falling back to floor when it cannot be persisted
+func nextSerial(zone string, floor uint32) uint32 {
+	if Serials == nil {
+		return max(floor, baseSerial(time.Now()))
+	}
+
+	serial, err := Serials.Next(zone, floor)
+	if err != nil {
+		journal.Logger.Sugar().With("Zone", zone, "Error", err.Error()).Error("Unable to persist SOA serial")
+		return floor
+	}
+
+	return serial
+}
@@ -0,0 +1,31 @@
+package dns
+
+import (
+	"github.com/betterde/cdns/pkg/store"
+	"testing"
+)
+
+func TestSerialsSurviveRestart(t *testing.T) {
+	useConfig(t, "")
+
+	var last uint32
+	for restart := 0; restart < 3; restart++ {
+		serials, err := serialStore(store.NewMemoryStore())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manager := NewSerialManager(serials)
+		for change := 0; change < 2; change++ {
+			serial, err := manager.Next(testOrigin, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if serial <= last {
+				t.Fatalf("serial %d after restart %d is not newer than %d", serial, restart, last)
+			}
+			last = serial
+		}
+	}
+}
@@ -1,133 +1,411 @@
 package dns
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/betterde/cdns/config"
 	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/internal/metrics"
+	"github.com/betterde/cdns/pkg/store"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"net"
 	"strings"
 	"sync"
 	"time"
 )
 
-var Servers []*Server
+// defaultTTL is used for static records without a TTL
+const defaultTTL = 3600
+
+// maxCNAMEChain limits how many CNAME records are followed for a single question
+const maxCNAMEChain = 8
+
+// ServerInstance holds the records answered by every listener
+var ServerInstance *Server
+
+// Store persists the dynamic records of the server
+var Store store.Store
 
 // Records is a slice of ResourceRecords
 type Records struct {
 	Records []dns.RR
 }
 
-// Server is the main struct for acme-dns DNS server
+// Server is the main struct for acme-dns DNS server, its records are shared by all listeners
 type Server struct {
 	A               dns.RR
 	SOA             dns.RR
 	Domain          string
-	Server          *dns.Server
+	Zones           []*Zone
 	Domains         map[string]Records
+	Listeners       []*dns.Server
 	PersonalKeyAuth string
+	static          map[dns.RR]struct{}
+	// names counts the records owned by every name and the names below it, empty non-terminals included
+	names         map[string]int
+	quicListeners []*quic.Listener
 	sync.RWMutex
 }
 
 func InitServer(errChan chan error) {
-	servers := make([]*Server, 0)
+	var err error
+	Store, err = store.New(config.Get().Storage)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	records, err := Store.Records()
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	zones, err := LoadZones(config.Get())
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	static, err := parseRecords(config.Get().DNS.Records)
+	if err != nil {
+		errChan <- err
+		return
+	}
 
-	if strings.HasPrefix(config.Conf.DNS.Protocol, "both") {
-		// Handle the case where DNS server should be started for both udp and tcp
-		udpProto := "udp"
-		tcpProto := "tcp"
-		if strings.HasSuffix(config.Conf.DNS.Protocol, "4") {
-			udpProto += "4"
-			tcpProto += "4"
-		} else if strings.HasSuffix(config.Conf.DNS.Protocol, "6") {
-			udpProto += "6"
-			tcpProto += "6"
+	listeners, err := listeners()
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	queries, err = newQueryLog(config.Get().DNS.QueryLog)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	serials, err := serialStore(Store)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	Serials = NewSerialManager(serials)
+	assignSerials(zones)
+
+	ServerInstance = newServer(config.Get(), zones, static, records)
+	metrics.GaugeFunc("dns", "txt_records", "TXT records served, including the static ones.", nil, ServerInstance.txtRecords)
+
+	for _, listener := range listeners {
+		// DNS-over-TLS and DNS-over-QUIC listeners are started by StartTLS once the certificate is available
+		if encrypted(listener.Protocol) {
+			continue
 		}
 
-		udpServer := newServer(config.Conf.DNS.Listen, udpProto)
-		servers = append(servers, udpServer)
+		go ServerInstance.Start(listener, nil, errChan)
+	}
 
-		tcpServer := newServer(config.Conf.DNS.Listen, tcpProto)
-		servers = append(servers, tcpServer)
+	// Secondaries may have missed changes while the server was down
+	for _, zone := range zones {
+		notifySecondaries(dns.Copy(zone.SOA))
+	}
 
-		// No need to parse records from config again
-		tcpServer.SOA = udpServer.SOA
+	if config.Get().DNS.DNSSEC.Enabled {
+		go manageKeys()
+	}
+}
+
+// Reload re-reads the configuration and rebuilds the static records of the server.
+// Dynamic records are kept, listener changes require a restart.
+// An invalid configuration is rejected and the configuration in use is kept.
+func Reload() error {
+	conf, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	zones, err := refreshZones(conf)
+	if err != nil {
+		return err
+	}
+
+	journal.Logger.Sugar().With("Zones", len(zones), "Records", len(conf.DNS.Records)).Info("Configuration reloaded")
+
+	return nil
+}
+
+// refreshZones loads the zones and static records of conf, which replaces the current configuration once both are valid
+func refreshZones(conf *config.Config) ([]*Zone, error) {
+	zones, err := LoadZones(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	static, err := parseRecords(conf.DNS.Records)
+	if err != nil {
+		return nil, err
+	}
 
-		go udpServer.Start(errChan)
-		go tcpServer.Start(errChan)
+	assignSerials(zones)
+	if ServerInstance != nil {
+		ServerInstance.reload(conf, zones, static)
 	} else {
-		dnsServer := newServer(config.Conf.DNS.Listen, config.Conf.DNS.Protocol)
-		servers = append(servers, dnsServer)
-		go dnsServer.Start(errChan)
+		config.Set(conf)
+	}
+
+	for _, zone := range zones {
+		notifySecondaries(dns.Copy(zone.SOA))
 	}
 
-	Servers = servers
+	return zones, nil
 }
 
-func newServer(addr, proto string) *Server {
+// listeners returns the configured listeners, the single listen address with the "both" protocols stands for udp and tcp.
+// The "tcp-tls" and "quic" protocols serve DNS-over-TLS (RFC 7858) and DNS-over-QUIC (RFC 9250) with the certificate of the HTTP server.
+func listeners() ([]config.Listener, error) {
+	conf := config.Get()
+	listeners := conf.DNS.Listeners
+	if len(listeners) == 0 {
+		protocol := conf.DNS.Protocol
+		if suffix, ok := strings.CutPrefix(protocol, "both"); ok {
+			listeners = []config.Listener{
+				{Listen: conf.DNS.Listen, Protocol: "udp" + suffix},
+				{Listen: conf.DNS.Listen, Protocol: "tcp" + suffix},
+			}
+		} else {
+			listeners = []config.Listener{{Listen: conf.DNS.Listen, Protocol: protocol}}
+		}
+	}
+
+	for _, listener := range listeners {
+		switch listener.Protocol {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		case "tcp-tls", "tcp4-tls", "tcp6-tls", "quic":
+			if mode := conf.HTTP.TLS.Mode; mode != config.TLSModeACME && mode != config.TLSModeFile {
+				return nil, fmt.Errorf("listener %s requires the %q or %q tls mode", listener.Listen, config.TLSModeACME, config.TLSModeFile)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported protocol %q of listener %s", listener.Protocol, listener.Listen)
+		}
+	}
+
+	return listeners, nil
+}
+
+func newServer(conf *config.Config, zones []*Zone, static, records []dns.RR) *Server {
 	var server Server
-	server.Server = &dns.Server{Addr: addr, Net: proto}
+	server.loadStatic(conf, zones, static)
+
+	// Restore the dynamic records persisted before the last shutdown
+	for _, rr := range records {
+		server.appendRR(rr)
+	}
+
+	return &server
+}
 
-	domain := config.Conf.HTTP.Domain
+// loadStatic builds the SOA, static and zone records from the configuration
+func (d *Server) loadStatic(conf *config.Config, zones []*Zone, static []dns.RR) {
+	domain := conf.HTTP.Domain
 	if !strings.HasSuffix(domain, ".") {
 		domain = domain + "."
 	}
-	server.Domain = strings.ToLower(domain)
-	server.Domains = make(map[string]Records)
+	d.Domain = strings.ToLower(domain)
+	d.Domains = make(map[string]Records)
+	d.names = make(map[string]int)
+
+	d.SOA = nil
+	d.Zones = zones
+	for _, zone := range zones {
+		// The zone built from the global SOA settings is the fallback for names outside every zone
+		if d.SOA == nil && zone.Origin == strings.ToLower(dns.Fqdn(conf.SOA.Domain)) {
+			d.SOA = zone.SOA
+		}
 
-	serial := time.Now().Format("2006010215")
-	// Add SOA
-	SOAStr := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 86400", strings.ToLower(config.Conf.SOA.Domain), strings.ToLower(config.Conf.DNS.NSName), strings.ToLower(config.Conf.DNS.Admin), serial)
-	SOARR, err := dns.NewRR(SOAStr)
-	if err != nil {
-		journal.Logger.Sugar().With("Error", err.Error(), "SOA", SOAStr).Error("Error while adding SOA record")
-	} else {
-		server.appendRR(SOARR)
-		server.SOA = SOARR
+		for _, rr := range zone.Records {
+			d.appendRR(rr)
+		}
 	}
 
-	if len(config.Conf.DNS.Records) > 0 {
-		server.appendStaticRecords()
+	for _, rr := range static {
+		d.appendRR(rr)
 	}
 
-	return &server
+	// Everything loaded so far comes from the configuration and is replaced on reload
+	d.static = make(map[dns.RR]struct{})
+	for _, domain := range d.Domains {
+		for _, rr := range domain.Records {
+			d.static[rr] = struct{}{}
+		}
+	}
 }
 
-func (d *Server) appendStaticRecords() {
-	for domain, record := range config.Conf.DNS.Records {
-		var dnsRecord dns.RR
-		switch record.Type {
-		case "A":
-			dnsRecord = &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   domain,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    3600,
-				},
-				A: net.ParseIP(record.Value),
+// reload rebuilds the SOA, static and zone records while keeping the dynamic records,
+// conf becomes the current configuration together with the new records
+func (d *Server) reload(conf *config.Config, zones []*Zone, static []dns.RR) {
+	fresh := &Server{}
+	fresh.loadStatic(conf, zones, static)
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, domain := range d.Domains {
+		for _, rr := range domain.Records {
+			if _, ok := d.static[rr]; !ok {
+				fresh.appendRR(rr)
 			}
-		default:
-			journal.Logger.Sugar().With("Domain", domain, "Type", record.Type).Error("Unsupported record type")
+		}
+	}
+
+	d.SOA = fresh.SOA
+	d.Zones = fresh.Zones
+	d.Domain = fresh.Domain
+	d.Domains = fresh.Domains
+	d.names = fresh.names
+	d.static = fresh.static
+	config.Set(conf)
+}
+
+// parseRecords parses the static records of the configuration, a record configured more than once is rejected
+func parseRecords(records config.Records) ([]dns.RR, error) {
+	var parsed []dns.RR
+	for _, entry := range records {
+		for domain, record := range entry {
+			rrs, err := parseStaticRecord(domain, record)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse record %s: %w", domain, err)
+			}
+
+			for _, rr := range rrs {
+				if containsRR(parsed, rr) {
+					return nil, fmt.Errorf("record %s is configured more than once", rr.String())
+				}
+				parsed = append(parsed, rr)
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+// parseStaticRecord builds the records of a domain from its RDATA in presentation format
+func parseStaticRecord(domain string, record config.Record) ([]dns.RR, error) {
+	rrtype := strings.ToUpper(record.Type)
+	if _, ok := dns.StringToType[rrtype]; !ok {
+		return nil, fmt.Errorf("unsupported record type %s", record.Type)
+	}
+
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
+	values := record.Values
+	if record.Value != "" {
+		values = append([]string{record.Value}, values...)
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no value for %s record", rrtype)
+	}
+
+	records := make([]dns.RR, 0, len(values))
+	for _, value := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", strings.ToLower(dns.Fqdn(domain)), ttl, rrtype, value))
+		if err != nil {
+			return nil, err
+		}
+
+		if rr == nil {
+			return nil, fmt.Errorf("empty %s record", rrtype)
+		}
+
+		records = append(records, rr)
+	}
+
+	return records, nil
+}
+
+// encrypted checks if the protocol of a listener is served over TLS or QUIC
+func encrypted(protocol string) bool {
+	return strings.HasSuffix(protocol, "-tls") || protocol == "quic"
+}
+
+// StartTLS serves the records on the DNS-over-TLS and DNS-over-QUIC listeners with the TLS configuration of the HTTP server
+func (d *Server) StartTLS(tlsConf *tls.Config, errorChannel chan error) {
+	listeners, err := listeners()
+	if err != nil {
+		errorChannel <- err
+		return
+	}
+
+	for _, listener := range listeners {
+		if !encrypted(listener.Protocol) {
+			continue
+		}
+
+		if tlsConf == nil {
+			errorChannel <- fmt.Errorf("no certificate for listener %s", listener.Listen)
+			return
+		}
+
+		conf := tlsConf.Clone()
+		if listener.Protocol == "quic" {
+			conf.NextProtos = []string{"doq"}
+			go d.startQUIC(listener, conf, errorChannel)
+			continue
 		}
 
-		d.appendRR(dnsRecord)
+		conf.NextProtos = []string{"dot"}
+		go d.Start(listener, conf, errorChannel)
 	}
 }
 
-// Start starts the DNSServer
-func (d *Server) Start(errorChannel chan error) {
-	// DNS server part
-	dns.HandleFunc(".", d.handleRequest)
+// Start serves the records on the listener until it is shut down, tlsConf is only used by DNS-over-TLS listeners
+func (d *Server) Start(listener config.Listener, tlsConf *tls.Config, errorChannel chan error) {
+	server := &dns.Server{
+		Addr:          listener.Listen,
+		Net:           listener.Protocol,
+		Handler:       d.instrument(listener.Protocol),
+		TLSConfig:     tlsConf,
+		TsigProvider:  tsigProvider{},
+		MsgAcceptFunc: acceptMsg,
+	}
+
+	d.Lock()
+	d.Listeners = append(d.Listeners, server)
+	d.Unlock()
 
-	journal.Logger.Sugar().With("Addr", d.Server.Addr, "Proto", d.Server.Net).Debug("Listening DNS")
+	journal.Logger.Sugar().With("Addr", server.Addr, "Proto", server.Net).Debug("Listening DNS")
 
-	err := d.Server.ListenAndServe()
+	err := server.ListenAndServe()
 	if err != nil {
 		errorChannel <- err
 	}
 }
 
+// Shutdown stops every listener and flushes the query log
+func (d *Server) Shutdown() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	var errs []error
+	for _, listener := range d.Listeners {
+		errs = append(errs, listener.Shutdown())
+	}
+
+	for _, listener := range d.quicListeners {
+		errs = append(errs, listener.Close())
+	}
+
+	errs = append(errs, queries.close())
+
+	return errors.Join(errs...)
+}
+
 func (d *Server) appendRR(rr dns.RR) {
 	addDomain := rr.Header().Name
 	_, ok := d.Domains[addDomain]
@@ -138,10 +416,53 @@ func (d *Server) appendRR(rr dns.RR) {
 		domain.Records = append(domain.Records, rr)
 		d.Domains[addDomain] = domain
 	}
+	d.countName(addDomain, 1)
 	journal.Logger.Sugar().With("Domain", addDomain, "RecordType", dns.TypeToString[rr.Header().Rrtype]).Debug("Adding new record to domain")
 }
 
 func (d *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode == dns.OpcodeQuery && len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		d.handleTransfer(w, r)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		d.handleUpdate(w, r)
+		return
+	}
+
+	m := d.respond(r)
+
+	// Signed answers may exceed the buffer size of UDP clients, which then retry over TCP
+	if w.LocalAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+// Exchange answers a query received over HTTP, zone transfers and updates are only served by the DNS listeners
+func Exchange(remote net.Addr, r *dns.Msg) *dns.Msg {
+	transfer := len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR)
+	if transfer || r.Opcode == dns.OpcodeUpdate {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		return m
+	}
+
+	start := time.Now()
+	m := ServerInstance.respond(r)
+	ServerInstance.observe("https", remote, r, m, start)
+
+	return m
+}
+
+// respond builds the response to a query
+func (d *Server) respond(r *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(r)
 
@@ -154,9 +475,12 @@ func (d *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 			m.SetEdns0(512, false)
 		} else {
 			// We can safely do this as we know that we're not setting other OPT RRs within acme-dns.
-			m.SetEdns0(512, false)
+			m.SetEdns0(512, opt.Do())
 			if r.Opcode == dns.OpcodeQuery {
 				d.readQuery(m)
+				if opt.Do() {
+					d.sign(m)
+				}
 			}
 		}
 	} else {
@@ -164,10 +488,14 @@ func (d *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 			d.readQuery(m)
 		}
 	}
-	_ = w.WriteMsg(m)
+
+	return m
 }
 
 func (d *Server) readQuery(m *dns.Msg) {
+	d.RLock()
+	defer d.RUnlock()
+
 	var authoritative = false
 	for _, que := range m.Question {
 		if rr, rc, auth, err := d.answer(que); err == nil {
@@ -179,19 +507,75 @@ func (d *Server) readQuery(m *dns.Msg) {
 		}
 	}
 	m.MsgHdr.Authoritative = authoritative
-	if authoritative {
-		if m.MsgHdr.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+	m.Extra = append(m.Extra, d.glue(m.Answer)...)
+
+	// RFC 2308, both NXDOMAIN and NODATA carry the SOA of the zone so that resolvers can cache them
+	if authoritative && len(m.Question) > 0 {
+		q := m.Question[0]
+		end := chainEnd(q.Name, m.Answer)
+		zone := d.zoneForType(end, q.Qtype)
+		inZone := zone != nil || d.isAuthoritative(dns.Question{Name: end})
+		if inZone && (m.MsgHdr.Rcode == dns.RcodeNameError || (m.MsgHdr.Rcode == dns.RcodeSuccess && !hasType(m.Answer, q.Qtype))) {
+			owner := end
+			if zone != nil {
+				owner = zone.Origin
+			}
+
+			if soa := d.negativeSOA(owner); soa != nil {
+				m.Ns = append(m.Ns, soa)
+			}
+		}
+	}
+}
+
+// glue returns the A and AAAA records we have for the name servers in the answer, for the additional section
+func (d *Server) glue(answer []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		for _, address := range d.Domains[strings.ToLower(ns.Ns)].Records {
+			if rrtype := address.Header().Rrtype; rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+				extra = append(extra, address)
+			}
+		}
+	}
+
+	return extra
+}
+
+// hasType checks if the answer contains records of the queried type
+func hasType(answer []dns.RR, qtype uint16) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// chainEnd returns the last name of the CNAME chain starting at name
+func chainEnd(name string, answer []dns.RR) string {
+	name = strings.ToLower(name)
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			name = strings.ToLower(cname.Target)
 		}
 	}
+
+	return name
 }
 
-func (d *Server) getRecord(q dns.Question) ([]dns.RR, error) {
+func (d *Server) getRecord(q dns.Question) []dns.RR {
 	var rr []dns.RR
 	var cnames []dns.RR
 	domain, ok := d.Domains[strings.ToLower(q.Name)]
 	if !ok {
-		return rr, fmt.Errorf("No records for domain %s", q.Name)
+		return rr
 	}
 	for _, ri := range domain.Records {
 		if ri.Header().Rrtype == q.Qtype {
@@ -202,9 +586,48 @@ func (d *Server) getRecord(q dns.Question) ([]dns.RR, error) {
 		}
 	}
 	if len(rr) == 0 {
-		return cnames, nil
+		return cnames
 	}
-	return rr, nil
+	return rr
+}
+
+// nameExists checks if a name owns records or is an empty non-terminal above names that do
+func (d *Server) nameExists(name string) bool {
+	name = strings.ToLower(name)
+	if domain, ok := d.Domains[name]; ok && len(domain.Records) > 0 {
+		return true
+	}
+
+	if d.isOwnChallenge(name) && d.PersonalKeyAuth != "" {
+		return true
+	}
+
+	return d.names[dns.Fqdn(name)] > 0
+}
+
+// countName adds delta to the record count of the owner name and each of its ancestors
+func (d *Server) countName(owner string, delta int) {
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(owner, offset) {
+		name := owner[offset:]
+		if d.names[name] += delta; d.names[name] <= 0 {
+			delete(d.names, name)
+		}
+	}
+}
+
+// negativeSOA returns the SOA for the authority section of negative answers, its TTL is capped by the SOA minimum
+func (d *Server) negativeSOA(name string) dns.RR {
+	soa, ok := d.soaFor(name).(*dns.SOA)
+	if !ok {
+		return nil
+	}
+
+	negative := dns.Copy(soa).(*dns.SOA)
+	if negative.Minttl < negative.Hdr.Ttl {
+		negative.Hdr.Ttl = negative.Minttl
+	}
+
+	return negative
 }
 
 // answeringForDomain checks if we have any records for a domain
@@ -247,63 +670,128 @@ func (d *Server) isOwnChallenge(name string) bool {
 }
 
 func (d *Server) answer(q dns.Question) ([]dns.RR, int, bool, error) {
-	var rcode int
-	var err error
-	var txtRRs []dns.RR
-	var authoritative = d.isAuthoritative(q)
-	if !d.isOwnChallenge(q.Name) && !d.answeringForDomain(q.Name) {
-		rcode = dns.RcodeNameError
+	var zone = d.zoneFor(q.Name)
+	var authoritative = zone != nil || d.isAuthoritative(q)
+	if !authoritative {
+		journal.Logger.Sugar().With("QType", dns.TypeToString[q.Qtype], "Domain", q.Name).Debug("Refusing question for domain outside of zones")
+		return nil, dns.RcodeRefused, false, nil
 	}
-	r, _ := d.getRecord(q)
 
-	if q.Qtype == dns.TypeA && len(r) == 0 {
-		var ip net.IP
-		if q.Name == fmt.Sprintf("%s.", config.Conf.DNS.NSName) {
-			ip = net.ParseIP(config.Conf.NS.IP)
-		} else {
-			ip = net.ParseIP(config.Conf.Ingress.IP)
+	r, rcode := d.lookup(q.Name, q.Qtype)
+
+	// Follow CNAME chains as long as the targets are in our own data, the rcode is the one of the last name
+	visited := map[string]bool{strings.ToLower(q.Name): true}
+	for depth := 0; depth < maxCNAMEChain && q.Qtype != dns.TypeCNAME; depth++ {
+		target := cnameTarget(r)
+		if target == "" || visited[target] || (d.zoneFor(target) == nil && !d.isAuthoritative(dns.Question{Name: target})) {
+			break
 		}
+		visited[target] = true
 
-		r = append(r, &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    3600,
-			},
-			A: ip,
-		})
+		var rr []dns.RR
+		rr, rcode = d.lookup(target, q.Qtype)
+		r = append(r, rr...)
 	}
 
-	if q.Qtype == dns.TypeNS && len(r) == 0 {
-		r = append(r, &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    3600,
-			},
-			Ns: fmt.Sprintf("%s.", config.Conf.DNS.NSName),
-		})
-	}
+	journal.Logger.Sugar().With("QType", dns.TypeToString[q.Qtype], "Domain", q.Name, "RCode", dns.RcodeToString[rcode]).Debug("Answering question for domain")
+
+	return r, rcode, authoritative, nil
+}
 
-	if q.Qtype == dns.TypeTXT {
-		if d.isOwnChallenge(q.Name) {
-			txtRRs, err = d.answerOwnChallenge(q)
+// lookup returns the records of name for the type, or its CNAME, and NXDOMAIN when the name does not exist
+func (d *Server) lookup(name string, qtype uint16) ([]dns.RR, int) {
+	q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+
+	// The parent answers for the DS RRset of a nested zone with the digests of its published KSKs
+	if zone := d.zoneFor(name); qtype == dns.TypeDS && zone != nil && d.zoneForType(name, qtype) != zone {
+		var r []dns.RR
+		for _, ds := range zone.DS(dns.SHA256, time.Now()) {
+			r = append(r, ds)
 		}
 
+		return r, dns.RcodeSuccess
+	}
+
+	r := d.getRecord(q)
+
+	if q.Qtype == dns.TypeTXT && d.isOwnChallenge(q.Name) && d.PersonalKeyAuth != "" {
+		txtRRs, err := d.answerOwnChallenge(q)
 		if err == nil {
 			r = append(r, txtRRs...)
 		}
 	}
-	if len(r) > 0 {
-		// Make sure that we return NOERROR if there were dynamic records for the domain
-		rcode = dns.RcodeSuccess
+
+	if len(r) > 0 || d.nameExists(q.Name) {
+		return r, dns.RcodeSuccess
+	}
+
+	if rr, ok := d.wildcard(q); ok {
+		return rr, dns.RcodeSuccess
+	}
+
+	zone := d.zoneFor(q.Name)
+	if zone == nil || zone.Ingress == nil {
+		return r, dns.RcodeNameError
+	}
+
+	// The wildcard ingress covers every name of the zone that does not exist, other types are NODATA
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		r = append(r, zone.ingressRecords(q.Name, q.Qtype)...)
+	}
+
+	return r, dns.RcodeSuccess
+}
+
+// wildcard synthesizes the answer of a name that does not exist from the wildcard at its closest encloser (RFC 4592)
+func (d *Server) wildcard(q dns.Question) ([]dns.RR, bool) {
+	source, ok := d.wildcardSource(q.Name)
+	if !ok {
+		return nil, false
+	}
+
+	records := d.getRecord(dns.Question{Name: source, Qtype: q.Qtype, Qclass: q.Qclass})
+	synthesized := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		synthesized = append(synthesized, rr)
+	}
+
+	return synthesized, true
+}
+
+// wildcardSource returns the wildcard owner at the closest encloser of a name that does not exist.
+// A wildcard never applies across an existing name, so only the closest encloser is considered.
+func (d *Server) wildcardSource(name string) (string, bool) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !d.nameExists(encloser) {
+			continue
+		}
+
+		source := "*." + encloser
+		if domain, ok := d.Domains[source]; ok && len(domain.Records) > 0 {
+			return source, true
+		}
+
+		return "", false
+	}
+
+	return "", false
+}
+
+// cnameTarget returns the target of the last CNAME in the records, if it is one
+func cnameTarget(r []dns.RR) string {
+	if len(r) == 0 {
+		return ""
 	}
 
-	journal.Logger.Sugar().With("QType", dns.TypeToString[q.Qtype], "Domain", q.Name, "RCode", dns.RcodeToString[rcode]).Debug("Answering question for domain")
+	if cname, ok := r[len(r)-1].(*dns.CNAME); ok {
+		return strings.ToLower(cname.Target)
+	}
 
-	return r, rcode, authoritative, nil
+	return ""
 }
 
 // answerOwnChallenge answers to ACME challenge for acme-dns own certificate
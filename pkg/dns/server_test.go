@@ -0,0 +1,300 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/pkg/store"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReloadKeepsConfigurationOnError(t *testing.T) {
+	useConfig(t, updatedZone)
+	ServerInstance = newTestServer(t)
+	before := config.Get()
+
+	data, err := os.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := append(data, "    - bad.example.test:\n        type: A\n        value: not-an-address\n"...)
+	if err = os.WriteFile(viper.ConfigFileUsed(), invalid, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Reload(); err == nil {
+		t.Fatal("invalid configuration reloaded")
+	}
+
+	if config.Get() != before {
+		t.Error("invalid configuration replaced the configuration in use")
+	}
+
+	if rrs := ServerInstance.Domains["www.example.test."].Records; len(rrs) != 2 {
+		t.Errorf("got %d records of www.example.test. after the failed reload, want 2", len(rrs))
+	}
+}
+
+func TestNameExists(t *testing.T) {
+	useConfig(t, "")
+	server := newTestServer(t)
+
+	previous := Store
+	t.Cleanup(func() { Store = previous })
+	Store = store.NewMemoryStore()
+
+	deep := mustRR(t, "a.b.c.example.test. 300 IN TXT \"deep\"")
+	other := mustRR(t, "a.b.c.example.test. 300 IN TXT \"other\"")
+	for _, rr := range []dns.RR{deep, other} {
+		if err := server.appendRecord(rr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"a.b.c.example.test.", "b.c.example.test.", "C.example.test", "example.test."} {
+		if !server.nameExists(name) {
+			t.Errorf("%s does not exist", name)
+		}
+	}
+
+	if server.nameExists("x.c.example.test.") {
+		t.Error("x.c.example.test. exists")
+	}
+
+	if err := server.removeRecord(deep); err != nil {
+		t.Fatal(err)
+	}
+
+	if !server.nameExists("b.c.example.test.") {
+		t.Error("empty non-terminal vanished while a record remains below it")
+	}
+
+	if err := server.removeRecord(other); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.b.c.example.test.", "b.c.example.test.", "c.example.test."} {
+		if server.nameExists(name) {
+			t.Errorf("%s still exists after its records were removed", name)
+		}
+	}
+
+	if !server.nameExists(testOrigin) {
+		t.Error("the zone apex vanished")
+	}
+}
+
+const negativeZone = `  zones:
+    - origin: other.test
+      admin: admin.other.test
+      nsname: ns.other.test
+      soa:
+        ttl: 3600
+        minimum: 60
+      records:
+        - www.other.test:
+            type: A
+            value: 192.0.2.20
+  records:
+    - www.example.test:
+        type: A
+        value: 192.0.2.10
+    - a.b.example.test:
+        type: A
+        value: 192.0.2.11
+`
+
+func TestNegativeAnswers(t *testing.T) {
+	useConfig(t, negativeZone)
+	server := newTestServer(t)
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		rcode         int
+		answers       int
+		authoritative bool
+		// soa is the owner of the SOA expected in the authority section, empty for none
+		soa string
+		ttl uint32
+	}{
+		{name: "existing data", qname: "www.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answers: 1, authoritative: true},
+		{name: "NODATA", qname: "www.example.test.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, authoritative: true, soa: testOrigin, ttl: defaultTTL},
+		{name: "NODATA at an empty non-terminal", qname: "b.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, authoritative: true, soa: testOrigin, ttl: defaultTTL},
+		{name: "NXDOMAIN", qname: "nx.example.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, authoritative: true, soa: testOrigin, ttl: defaultTTL},
+		{name: "NXDOMAIN below a name", qname: "nx.www.example.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, authoritative: true, soa: testOrigin, ttl: defaultTTL},
+		{name: "NODATA with TTL capped by the SOA minimum", qname: "www.other.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, authoritative: true, soa: "other.test.", ttl: 60},
+		{name: "NXDOMAIN with TTL capped by the SOA minimum", qname: "nx.other.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, authoritative: true, soa: "other.test.", ttl: 60},
+		{name: "outside every zone", qname: "www.example.org.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, tt.qtype)
+			m := server.respond(r)
+
+			if m.Rcode != tt.rcode || m.Authoritative != tt.authoritative || len(m.Answer) != tt.answers {
+				t.Fatalf("got %s, authoritative %t, %d answers, want %s, authoritative %t, %d answers",
+					dns.RcodeToString[m.Rcode], m.Authoritative, len(m.Answer), dns.RcodeToString[tt.rcode], tt.authoritative, tt.answers)
+			}
+
+			if tt.soa == "" {
+				if len(m.Ns) > 0 {
+					t.Errorf("got authority %v, want none", m.Ns)
+				}
+				return
+			}
+
+			if len(m.Ns) != 1 {
+				t.Fatalf("got authority %v, want the SOA of %s", m.Ns, tt.soa)
+			}
+
+			soa, ok := m.Ns[0].(*dns.SOA)
+			if !ok || soa.Hdr.Name != tt.soa || soa.Hdr.Ttl != tt.ttl {
+				t.Errorf("got authority %v, want the SOA of %s with TTL %d", m.Ns[0], tt.soa, tt.ttl)
+			}
+		})
+	}
+}
+
+// record returns a static record entry of the test configuration, quoted so that wildcard owners are no YAML aliases
+func record(name, rrtype, value string) string {
+	return fmt.Sprintf("    - %q:\n        type: %s\n        value: %q\n", name, rrtype, value)
+}
+
+func TestCNAMEChain(t *testing.T) {
+	records := record("www.example.test", "A", "192.0.2.10") +
+		record("alias.example.test", "CNAME", "www.example.test") +
+		record("loop1.example.test", "CNAME", "loop2.example.test") +
+		record("loop2.example.test", "CNAME", "loop1.example.test") +
+		record("dangling.example.test", "CNAME", "nx.example.test") +
+		record("external.example.test", "CNAME", "www.example.org")
+	for i := 0; i < 10; i++ {
+		records += record(fmt.Sprintf("chain%d.example.test", i), "CNAME", fmt.Sprintf("chain%d.example.test", i+1))
+	}
+	records += record("chain10.example.test", "A", "192.0.2.11")
+
+	useConfig(t, "  records:\n"+records)
+	server := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode int
+		// answer are the owner and type of every answer record in order
+		answer []string
+	}{
+		{name: "alias", qname: "alias.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{"alias.example.test. CNAME", "www.example.test. A"}},
+		{name: "alias NODATA", qname: "alias.example.test.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, answer: []string{"alias.example.test. CNAME"}},
+		{name: "CNAME query", qname: "alias.example.test.", qtype: dns.TypeCNAME, rcode: dns.RcodeSuccess, answer: []string{"alias.example.test. CNAME"}},
+		{name: "target does not exist", qname: "dangling.example.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError, answer: []string{"dangling.example.test. CNAME"}},
+		{name: "target outside the zones", qname: "external.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{"external.example.test. CNAME"}},
+		{name: "loop", qname: "loop1.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{"loop1.example.test. CNAME", "loop2.example.test. CNAME"}},
+		{name: "depth limit", qname: "chain0.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{
+			"chain0.example.test. CNAME", "chain1.example.test. CNAME", "chain2.example.test. CNAME",
+			"chain3.example.test. CNAME", "chain4.example.test. CNAME", "chain5.example.test. CNAME",
+			"chain6.example.test. CNAME", "chain7.example.test. CNAME", "chain8.example.test. CNAME",
+		}},
+		{name: "within the depth limit", qname: "chain2.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{
+			"chain2.example.test. CNAME", "chain3.example.test. CNAME", "chain4.example.test. CNAME",
+			"chain5.example.test. CNAME", "chain6.example.test. CNAME", "chain7.example.test. CNAME",
+			"chain8.example.test. CNAME", "chain9.example.test. CNAME", "chain10.example.test. A",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, rcode, authoritative, err := server.answer(dns.Question{Name: tt.qname, Qtype: tt.qtype, Qclass: dns.ClassINET})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rcode != tt.rcode || !authoritative {
+				t.Errorf("got %s, authoritative %t, want %s", dns.RcodeToString[rcode], authoritative, dns.RcodeToString[tt.rcode])
+			}
+
+			answer := make([]string, 0, len(rr))
+			for _, r := range rr {
+				answer = append(answer, r.Header().Name+" "+dns.TypeToString[r.Header().Rrtype])
+			}
+
+			if strings.Join(answer, ", ") != strings.Join(tt.answer, ", ") {
+				t.Errorf("got answer %v, want %v", answer, tt.answer)
+			}
+		})
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	useConfig(t, `  zones:
+    - origin: ingress.test
+      admin: admin.ingress.test
+      nsname: ns.ingress.test
+      ingress:
+        wildcard: true
+        ip: 192.0.2.40
+        addresses:
+          - 2001:db8::40
+    - origin: plain.test
+      admin: admin.plain.test
+      nsname: ns.plain.test
+      ingress:
+        ip: 192.0.2.41
+  records:
+`+record("*.example.test", "TXT", "wild")+
+		record("*.sub.example.test", "A", "192.0.2.30")+
+		record("host.sub.example.test", "A", "192.0.2.31"))
+	server := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode int
+		// answer are the owner, type and RDATA of every answer record
+		answer []string
+	}{
+		{name: "synthesized", qname: "x.example.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, answer: []string{`x.example.test. TXT "wild"`}},
+		{name: "synthesized NODATA", qname: "x.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},
+		{name: "several labels below the closest encloser", qname: "y.x.example.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, answer: []string{`y.x.example.test. TXT "wild"`}},
+		{name: "wildcard owner", qname: "*.example.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, answer: []string{`*.example.test. TXT "wild"`}},
+		{name: "closest encloser", qname: "x.sub.example.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{"x.sub.example.test. A 192.0.2.30"}},
+		{name: "only the closest encloser", qname: "x.sub.example.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess},
+		{name: "existing name", qname: "host.sub.example.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess},
+		{name: "below an existing name", qname: "y.host.sub.example.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "ingress", qname: "nx.ingress.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: []string{"nx.ingress.test. A 192.0.2.40"}},
+		{name: "ingress IPv6", qname: "nx.ingress.test.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, answer: []string{"nx.ingress.test. AAAA 2001:db8::40"}},
+		{name: "ingress NODATA", qname: "nx.ingress.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess},
+		{name: "ingress off", qname: "nx.plain.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, rcode, _, err := server.answer(dns.Question{Name: tt.qname, Qtype: tt.qtype, Qclass: dns.ClassINET})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rcode != tt.rcode {
+				t.Errorf("got %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+			}
+
+			answer := make([]string, 0, len(rr))
+			for _, r := range rr {
+				rdata := strings.TrimPrefix(r.String(), r.Header().String())
+				answer = append(answer, r.Header().Name+" "+dns.TypeToString[r.Header().Rrtype]+" "+rdata)
+			}
+
+			if strings.Join(answer, ", ") != strings.Join(tt.answer, ", ") {
+				t.Errorf("got answer %v, want %v", answer, tt.answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testOrigin is the zone built from the global settings of the test configuration
+const testOrigin = "example.test."
+
+// useConfig makes the configuration with the given dns section and DNSSEC keys in a temporary directory current
+func useConfig(t *testing.T, dnsSection string) {
+	t.Helper()
+
+	journal.Logger = zap.NewNop()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cdns.yaml")
+	conf := fmt.Sprintf(`ns:
+  ip: 192.0.2.1
+soa:
+  domain: example.test
+http:
+  domain: acme.example.test
+providers:
+  acme:
+    storage: %s
+dns:
+  admin: admin.example.test
+  nsname: ns.example.test
+%s`, dir, dnsSection)
+
+	if err := os.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Parse(file)
+}
+
+// newTestServer loads the zones and static records of the current configuration
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	zones, err := LoadZones(config.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	static, err := parseRecords(config.Get().DNS.Records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newServer(config.Get(), zones, static, nil)
+}
+
+// mustRR parses a record in presentation format
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxChanges limits the changes kept per zone for IXFR, older serials get a full transfer
+	maxChanges = 256
+	// transferChunk is the number of records sent per message of a transfer
+	transferChunk = 128
+)
+
+// Change is the difference between two serials of a zone, used to answer IXFR (RFC 1995)
+type Change struct {
+	From    uint32
+	To      uint32
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// commit bumps the serial of the zone and records the change, the caller holds the lock of the server
+func (z *Zone) commit(deleted, added []dns.RR) bool {
+	soa, ok := z.SOA.(*dns.SOA)
+	if !ok || len(deleted)+len(added) == 0 {
+		return false
+	}
+
+	from := soa.Serial
+	soa.Serial = nextSerial(z.Origin, soa.Serial+1)
+
+	z.Changes = append(z.Changes, &Change{From: from, To: soa.Serial, Deleted: deleted, Added: added})
+	if len(z.Changes) > maxChanges {
+		z.Changes = z.Changes[len(z.Changes)-maxChanges:]
+	}
+
+	return true
+}
+
+// changesSince returns the changes from serial to the current one, false if they are no longer known
+func (z *Zone) changesSince(serial uint32) ([]*Change, bool) {
+	for i, change := range z.Changes {
+		if change.From == serial {
+			return z.Changes[i:], true
+		}
+	}
+
+	return nil, false
+}
+
+// handleTransfer answers AXFR and IXFR requests of the secondaries allowed by the configuration
+func (d *Server) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if !transferAllowed(w, r) {
+		journal.Logger.Sugar().With("Domain", q.Name, "QType", dns.TypeToString[q.Qtype], "Remote", w.RemoteAddr().String()).Warn("Refusing zone transfer")
+		m.MsgHdr.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	// AXFR is only defined over TCP, IXFR over UDP gets the current SOA so that the client retries over TCP (RFC 1995)
+	udp := w.LocalAddr().Network() == "udp"
+	if udp && q.Qtype == dns.TypeAXFR {
+		m.MsgHdr.Rcode = dns.RcodeNotImplemented
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	records, ok := d.transferRecords(q, r)
+	if !ok {
+		m.MsgHdr.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	if udp {
+		m.MsgHdr.Authoritative = true
+		m.Answer = records[:1]
+		if tsig := r.IsTsig(); tsig != nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		}
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	ch := make(chan *dns.Envelope)
+	transfer := new(dns.Transfer)
+	go func() {
+		for i := 0; i < len(records); i += transferChunk {
+			ch <- &dns.Envelope{RR: records[i:min(i+transferChunk, len(records))]}
+		}
+		close(ch)
+	}()
+
+	if err := transfer.Out(w, r, ch); err != nil {
+		journal.Logger.Sugar().With("Domain", q.Name, "Remote", w.RemoteAddr().String(), "Error", err.Error()).Error("Unable to transfer zone")
+		// Drain the channel so that the producer does not block forever
+		for range ch {
+		}
+		return
+	}
+
+	journal.Logger.Sugar().With("Domain", q.Name, "QType", dns.TypeToString[q.Qtype], "Remote", w.RemoteAddr().String(), "Records", len(records)).Info("Transferred zone")
+}
+
+// transferRecords returns the records of the transfer, false if the question is not for the origin of one of our zones
+func (d *Server) transferRecords(q dns.Question, r *dns.Msg) ([]dns.RR, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	zone := d.zoneFor(q.Name)
+	if zone == nil || zone.Origin != strings.ToLower(dns.Fqdn(q.Name)) {
+		return nil, false
+	}
+
+	soa := dns.Copy(zone.SOA).(*dns.SOA)
+
+	if q.Qtype == dns.TypeIXFR {
+		if serial, ok := clientSerial(r); ok {
+			// The client is up-to-date, a single SOA tells it so
+			if serial == soa.Serial {
+				return []dns.RR{soa}, true
+			}
+
+			if changes, ok := zone.changesSince(serial); ok {
+				records := []dns.RR{soa}
+				for _, change := range changes {
+					from := dns.Copy(soa).(*dns.SOA)
+					from.Serial = change.From
+					to := dns.Copy(soa).(*dns.SOA)
+					to.Serial = change.To
+
+					records = append(records, from)
+					records = append(records, change.Deleted...)
+					records = append(records, to)
+					records = append(records, change.Added...)
+				}
+
+				return append(records, soa), true
+			}
+		}
+	}
+
+	// AXFR, or IXFR falling back to a full transfer
+	records := []dns.RR{soa}
+	records = append(records, d.zoneRecords(zone)...)
+
+	return append(records, soa), true
+}
+
+// zoneRecords returns the records of a zone except its SOA. The online signing records are left out,
+// secondaries of a signed zone have to sign it themselves.
+func (d *Server) zoneRecords(zone *Zone) []dns.RR {
+	owners := make([]string, 0, len(d.Domains))
+	for owner := range d.Domains {
+		if d.zoneFor(owner) == zone {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+
+	records := make([]dns.RR, 0, len(owners))
+	for _, owner := range owners {
+		for _, rr := range d.Domains[owner].Records {
+			switch rr.Header().Rrtype {
+			case dns.TypeSOA, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG:
+				continue
+			}
+
+			records = append(records, rr)
+		}
+	}
+
+	for _, child := range d.Zones {
+		if child != zone && d.parentZone(child) == zone {
+			records = append(records, d.delegation(child, time.Now())...)
+		}
+	}
+
+	// The wildcard ingress is the closest a secondary can get to the ingress synthesis
+	wildcard := "*." + zone.Origin
+	if len(d.Domains[wildcard].Records) == 0 {
+		records = append(records, zone.ingressRecords(wildcard, dns.TypeA)...)
+		records = append(records, zone.ingressRecords(wildcard, dns.TypeAAAA)...)
+	}
+
+	return records
+}
+
+// clientSerial returns the serial of the SOA in the authority section of an IXFR request
+func clientSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+
+	return 0, false
+}
+
+// transferAllowed checks the client address against the ACL and the TSIG signature against the transfer keys
+func transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	conf := config.Get().DNS.Transfer
+
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	if !addressAllowed(net.ParseIP(host), conf.Allow) {
+		return false
+	}
+
+	// A signature that does not verify is never accepted, even when no key is required
+	if r.IsTsig() != nil && w.TsigStatus() != nil {
+		return false
+	}
+
+	if len(conf.Keys) == 0 {
+		return true
+	}
+
+	signer := signedWith(w, r)
+	for _, key := range conf.Keys {
+		if signer != "" && signer == dns.CanonicalName(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addressAllowed checks if the address matches one of the addresses or CIDR ranges
+func addressAllowed(ip net.IP, acl []string) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range acl {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestChangesSince(t *testing.T) {
+	useConfig(t, "")
+	zone := newTestServer(t).zoneFor(testOrigin)
+
+	serials := []uint32{zone.SOA.(*dns.SOA).Serial}
+	for i := 0; i < 3; i++ {
+		added := mustRR(t, fmt.Sprintf("host%d.example.test. 300 IN A 192.0.2.%d", i, i+10))
+		if !zone.commit(nil, []dns.RR{added}) {
+			t.Fatal("change not committed")
+		}
+		serials = append(serials, zone.SOA.(*dns.SOA).Serial)
+	}
+
+	if zone.commit(nil, nil) {
+		t.Error("empty change committed")
+	}
+
+	tests := []struct {
+		name    string
+		serial  uint32
+		changes int
+		known   bool
+	}{
+		{name: "oldest serial", serial: serials[0], changes: 3, known: true},
+		{name: "intermediate serial", serial: serials[2], changes: 1, known: true},
+		{name: "current serial", serial: serials[3]},
+		{name: "unknown serial", serial: serials[0] - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, known := zone.changesSince(tt.serial)
+			if known != tt.known || len(changes) != tt.changes {
+				t.Fatalf("got %d changes, known %t, want %d changes, known %t", len(changes), known, tt.changes, tt.known)
+			}
+
+			// The changes chain from the requested serial to the current one
+			from := tt.serial
+			for _, change := range changes {
+				if change.From != from || change.To <= change.From {
+					t.Errorf("change from %d to %d does not follow serial %d", change.From, change.To, from)
+				}
+				from = change.To
+			}
+
+			if known && from != serials[len(serials)-1] {
+				t.Errorf("changes end at serial %d, want %d", from, serials[len(serials)-1])
+			}
+		})
+	}
+}
+
+func TestChangesSinceTrimmed(t *testing.T) {
+	useConfig(t, "")
+	zone := newTestServer(t).zoneFor(testOrigin)
+
+	first := zone.SOA.(*dns.SOA).Serial
+	for i := 0; i <= maxChanges; i++ {
+		zone.commit(nil, []dns.RR{mustRR(t, fmt.Sprintf("host%d.example.test. 300 IN A 192.0.2.1", i))})
+	}
+
+	if len(zone.Changes) != maxChanges {
+		t.Fatalf("%d changes kept, want %d", len(zone.Changes), maxChanges)
+	}
+
+	if _, known := zone.changesSince(first); known {
+		t.Error("changes since a trimmed serial are still known, the client needs a full transfer")
+	}
+
+	if changes, known := zone.changesSince(zone.Changes[0].From); !known || len(changes) != maxChanges {
+		t.Errorf("got %d changes since the oldest kept serial, want %d", len(changes), maxChanges)
+	}
+}
@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/betterde/cdns/config"
+	"github.com/miekg/dns"
+	"hash"
+	"strings"
+)
+
+// tsigProvider signs and verifies TSIG with the keys of the current configuration, so that reloads apply to running servers
+type tsigProvider struct{}
+
+func (tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key := tsigKey(t.Hdr.Name)
+	if key == nil {
+		return nil, dns.ErrSecret
+	}
+
+	if tsigAlgorithm(key) != dns.CanonicalName(t.Algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch tsigAlgorithm(key) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, secret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, secret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+
+	h.Write(msg)
+
+	return h.Sum(nil), nil
+}
+
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+// tsigKey returns the configured key with the name, nil if there is none
+func tsigKey(name string) *config.TSIGKey {
+	for i, key := range config.Get().DNS.TSIG {
+		if strings.EqualFold(dns.Fqdn(key.Name), dns.Fqdn(name)) {
+			return &config.Get().DNS.TSIG[i]
+		}
+	}
+
+	return nil
+}
+
+// tsigAlgorithm returns the canonical algorithm name of a key, HMAC-SHA256 by default
+func tsigAlgorithm(key *config.TSIGKey) string {
+	if key.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+
+	return dns.CanonicalName(key.Algorithm)
+}
+
+// signedWith returns the name of the key that signed the request, empty if it is unsigned or the signature is invalid
+func signedWith(w dns.ResponseWriter, r *dns.Msg) string {
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return ""
+	}
+
+	return dns.CanonicalName(tsig.Hdr.Name)
+}
@@ -0,0 +1,374 @@
+package dns
+
+import (
+	"errors"
+	"github.com/betterde/cdns/config"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/betterde/cdns/internal/match"
+	"github.com/miekg/dns"
+	"slices"
+	"strings"
+	"time"
+)
+
+// managedTypes are maintained by the server itself and ignored in UPDATE requests
+var managedTypes = map[uint16]bool{
+	dns.TypeSOA:        true,
+	dns.TypeRRSIG:      true,
+	dns.TypeNSEC:       true,
+	dns.TypeNSEC3:      true,
+	dns.TypeDNSKEY:     true,
+	dns.TypeNSEC3PARAM: true,
+}
+
+// acceptMsg accepts RFC 2136 UPDATE requests, whose sections may hold any number of records, on top of the defaults
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// handleUpdate applies an RFC 2136 UPDATE request signed with a TSIG key allowed by the update policies
+func (d *Server) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.MsgHdr.Rcode = d.update(w, r)
+
+	journal.Logger.Sugar().With("Zone", r.Question[0].Name, "Key", signedWith(w, r), "Remote", w.RemoteAddr().String(), "RCode", dns.RcodeToString[m.MsgHdr.Rcode]).Info("Handled UPDATE request")
+
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+// update checks the prerequisites and the update section before applying any change, returning the rcode of the response.
+// When the storage fails part-way, the changes applied so far are rolled back (RFC 2136 section 3.4.2).
+func (d *Server) update(w dns.ResponseWriter, r *dns.Msg) int {
+	q := r.Question[0]
+	if q.Qtype != dns.TypeSOA || q.Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+
+	key := signedWith(w, r)
+	if key == "" {
+		return dns.RcodeRefused
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	zone := d.zoneFor(q.Name)
+	if zone == nil || zone.Origin != strings.ToLower(dns.Fqdn(q.Name)) {
+		return dns.RcodeNotAuth
+	}
+
+	policies := updatePolicies(key, zone.Origin)
+	if len(policies) == 0 {
+		return dns.RcodeRefused
+	}
+
+	if rcode := d.checkPrerequisites(zone, r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	for _, rr := range r.Ns {
+		if rcode := prescan(zone, rr); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+
+		if !updateAllowed(policies, rr) {
+			return dns.RcodeRefused
+		}
+	}
+
+	steps, err := d.applyUpdates(r.Ns)
+	if err != nil {
+		journal.Logger.Sugar().With("Zone", zone.Origin, "Changes", len(steps), "Error", err.Error()).Error("Unable to apply UPDATE request")
+		if err = d.rollback(steps); err != nil {
+			journal.Logger.Sugar().With("Zone", zone.Origin, "Error", err.Error()).Error("Unable to roll back UPDATE request")
+		}
+
+		return dns.RcodeServerFailure
+	}
+
+	var deleted, added []dns.RR
+	for _, step := range steps {
+		if step.added {
+			added = append(added, step.rr)
+		} else {
+			deleted = append(deleted, step.rr)
+		}
+	}
+	d.commit(zone.Origin, deleted, added)
+
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section 3.2)
+func (d *Server) checkPrerequisites(zone *Zone, prerequisites []dns.RR) int {
+	// Value dependent prerequisites are compared per RRset once all of them are collected
+	expected := make(map[dns.Question][]dns.RR)
+	for _, rr := range prerequisites {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		if !dns.IsSubDomain(zone.Origin, name) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+
+			if hdr.Rrtype == dns.TypeANY && len(d.Domains[name].Records) == 0 {
+				return dns.RcodeNameError
+			}
+
+			if hdr.Rrtype != dns.TypeANY && len(d.rrset(name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+
+			if hdr.Rrtype == dns.TypeANY && len(d.Domains[name].Records) > 0 {
+				return dns.RcodeYXDomain
+			}
+
+			if hdr.Rrtype != dns.TypeANY && len(d.rrset(name, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := dns.Question{Name: name, Qtype: hdr.Rrtype, Qclass: hdr.Class}
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, records := range expected {
+		existing := d.rrset(key.Name, key.Qtype)
+		if len(existing) != len(records) {
+			return dns.RcodeNXRrset
+		}
+
+		for _, rr := range records {
+			if !containsRR(existing, rr) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// prescan validates a record of the update section (RFC 2136 section 3.4.1)
+func prescan(zone *Zone, rr dns.RR) int {
+	hdr := rr.Header()
+	if !dns.IsSubDomain(zone.Origin, strings.ToLower(hdr.Name)) {
+		return dns.RcodeNotZone
+	}
+
+	meta := hdr.Rrtype == dns.TypeAXFR || hdr.Rrtype == dns.TypeIXFR || hdr.Rrtype == dns.TypeMAILA || hdr.Rrtype == dns.TypeMAILB
+	switch hdr.Class {
+	case dns.ClassINET:
+		// Records without RDATA are unpacked with zero values, only the RDATA length tells them apart
+		if hdr.Rdlength == 0 || meta || hdr.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassANY:
+		if meta || hdr.Ttl != 0 || hdr.Rdlength != 0 {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if meta || hdr.Rrtype == dns.TypeANY || hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+
+	return dns.RcodeSuccess
+}
+
+// updateStep is a record added or deleted while applying an update section
+type updateStep struct {
+	rr    dns.RR
+	added bool
+}
+
+// applyUpdates adds and deletes the records of the update section in order (RFC 2136 section 3.4.2), returning
+// the changes made, also before an error. Only dynamic records are deleted, records of the configuration and zone
+// files stay until they are changed there.
+func (d *Server) applyUpdates(updates []dns.RR) ([]updateStep, error) {
+	var steps []updateStep
+	for _, update := range updates {
+		hdr := update.Header()
+		name := strings.ToLower(hdr.Name)
+		if managedTypes[hdr.Rrtype] {
+			continue
+		}
+
+		if hdr.Class == dns.ClassINET {
+			rr := dns.Copy(update)
+			rr.Header().Name = name
+			if d.conflicts(rr) {
+				continue
+			}
+
+			if err := d.appendRecord(rr); err != nil {
+				return steps, err
+			}
+			steps = append(steps, updateStep{rr: rr, added: true})
+			continue
+		}
+
+		// Class NONE deletes the records matching the RDATA, class ANY the whole RRset or all RRsets of the name
+		var target dns.RR
+		if hdr.Class == dns.ClassNONE {
+			target = dns.Copy(update)
+			target.Header().Name = name
+			target.Header().Class = dns.ClassINET
+		}
+
+		var removed []dns.RR
+		for _, rr := range d.Domains[name].Records {
+			if _, static := d.static[rr]; static || managedTypes[rr.Header().Rrtype] {
+				continue
+			}
+
+			if hdr.Rrtype != dns.TypeANY && rr.Header().Rrtype != hdr.Rrtype {
+				continue
+			}
+
+			if target == nil || dns.IsDuplicate(rr, target) {
+				removed = append(removed, rr)
+			}
+		}
+
+		for _, rr := range removed {
+			if err := d.removeRecord(rr); err != nil {
+				return steps, err
+			}
+			steps = append(steps, updateStep{rr: rr})
+		}
+	}
+
+	return steps, nil
+}
+
+// rollback undoes the changes of applyUpdates in reverse order, in the store and the server
+func (d *Server) rollback(steps []updateStep) error {
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].added {
+			errs = append(errs, d.removeRecord(steps[i].rr))
+		} else {
+			errs = append(errs, d.appendRecord(steps[i].rr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// conflicts checks if the record already exists, or if a CNAME would share its name with other data
+func (d *Server) conflicts(rr dns.RR) bool {
+	existing := d.Domains[rr.Header().Name].Records
+	if containsRR(existing, rr) {
+		return true
+	}
+
+	for _, other := range existing {
+		if managedTypes[other.Header().Rrtype] {
+			continue
+		}
+
+		if (rr.Header().Rrtype == dns.TypeCNAME) != (other.Header().Rrtype == dns.TypeCNAME) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rrset returns the records of name with the type
+func (d *Server) rrset(name string, rrtype uint16) []dns.RR {
+	var records []dns.RR
+	for _, rr := range d.Domains[name].Records {
+		if rr.Header().Rrtype == rrtype {
+			records = append(records, rr)
+		}
+	}
+
+	return records
+}
+
+// containsRR checks if the records contain one with the same owner, type and RDATA, ignoring the TTL
+func containsRR(records []dns.RR, rr dns.RR) bool {
+	rr = dns.Copy(rr)
+	rr.Header().Class = dns.ClassINET
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+
+	for _, existing := range records {
+		if dns.IsDuplicate(existing, rr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updatePolicies returns the policies of the key that include the zone
+func updatePolicies(key, origin string) []config.UpdatePolicy {
+	var policies []config.UpdatePolicy
+	for _, policy := range config.Get().DNS.Update {
+		if dns.CanonicalName(policy.Key) != key {
+			continue
+		}
+
+		if len(policy.Zones) > 0 && !slices.ContainsFunc(policy.Zones, func(zone string) bool {
+			return dns.CanonicalName(zone) == origin
+		}) {
+			continue
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies
+}
+
+// updateAllowed checks if one of the policies allows the name and type of the update
+func updateAllowed(policies []config.UpdatePolicy, rr dns.RR) bool {
+	name := strings.TrimSuffix(strings.ToLower(rr.Header().Name), ".")
+	for _, policy := range policies {
+		if len(policy.Types) > 0 && !slices.ContainsFunc(policy.Types, func(rrtype string) bool {
+			return dns.StringToType[strings.ToUpper(rrtype)] == rr.Header().Rrtype
+		}) {
+			continue
+		}
+
+		if len(policy.Names) == 0 || slices.ContainsFunc(policy.Names, func(pattern string) bool {
+			return match.Domain(name, strings.TrimSuffix(strings.ToLower(pattern), "."))
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"errors"
+	"github.com/betterde/cdns/pkg/store"
+	"github.com/miekg/dns"
+	"path/filepath"
+	"testing"
+)
+
+const updatedZone = `  records:
+    - www.example.test:
+        type: A
+        value: 192.0.2.10
+    - www.example.test:
+        type: A
+        value: 192.0.2.11
+`
+
+// unpacked returns the records as a server receives them, records without RDATA only have a header
+func unpacked(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetUpdate(testOrigin)
+	m.Ns = rrs
+
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.Ns
+}
+
+// header returns a record without RDATA
+func header(name string, rrtype, class uint16, ttl uint32) dns.RR {
+	return &dns.RR_Header{Name: name, Rrtype: rrtype, Class: class, Ttl: ttl}
+}
+
+// withClass returns a copy of the record with another class and TTL
+func withClass(rr dns.RR, class uint16, ttl uint32) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Class = class
+	rr.Header().Ttl = ttl
+
+	return rr
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	useConfig(t, updatedZone)
+	server := newTestServer(t)
+	zone := server.zoneFor(testOrigin)
+
+	www := mustRR(t, "www.example.test. 0 IN A 192.0.2.10")
+	www2 := mustRR(t, "www.example.test. 0 IN A 192.0.2.11")
+	other := mustRR(t, "www.example.test. 0 IN A 192.0.2.12")
+
+	tests := []struct {
+		name          string
+		prerequisites []dns.RR
+		rcode         int
+	}{
+		{name: "none", rcode: dns.RcodeSuccess},
+		{name: "name in use", prerequisites: []dns.RR{header("www.example.test.", dns.TypeANY, dns.ClassANY, 0)}, rcode: dns.RcodeSuccess},
+		{name: "name not in use", prerequisites: []dns.RR{header("nx.example.test.", dns.TypeANY, dns.ClassANY, 0)}, rcode: dns.RcodeNameError},
+		{name: "RRset exists", prerequisites: []dns.RR{header("www.example.test.", dns.TypeA, dns.ClassANY, 0)}, rcode: dns.RcodeSuccess},
+		{name: "RRset missing", prerequisites: []dns.RR{header("www.example.test.", dns.TypeAAAA, dns.ClassANY, 0)}, rcode: dns.RcodeNXRrset},
+		{name: "name must not exist", prerequisites: []dns.RR{header("www.example.test.", dns.TypeANY, dns.ClassNONE, 0)}, rcode: dns.RcodeYXDomain},
+		{name: "name does not exist", prerequisites: []dns.RR{header("nx.example.test.", dns.TypeANY, dns.ClassNONE, 0)}, rcode: dns.RcodeSuccess},
+		{name: "RRset must not exist", prerequisites: []dns.RR{header("www.example.test.", dns.TypeA, dns.ClassNONE, 0)}, rcode: dns.RcodeYXRrset},
+		{name: "RRset does not exist", prerequisites: []dns.RR{header("www.example.test.", dns.TypeTXT, dns.ClassNONE, 0)}, rcode: dns.RcodeSuccess},
+		{name: "RRset equal", prerequisites: []dns.RR{www2, www}, rcode: dns.RcodeSuccess},
+		{name: "RRset partially given", prerequisites: []dns.RR{www}, rcode: dns.RcodeNXRrset},
+		{name: "RRset differs", prerequisites: []dns.RR{www, other}, rcode: dns.RcodeNXRrset},
+		{name: "TTL set", prerequisites: []dns.RR{header("www.example.test.", dns.TypeANY, dns.ClassANY, 300)}, rcode: dns.RcodeFormatError},
+		{name: "RDATA with class ANY", prerequisites: []dns.RR{withClass(www, dns.ClassANY, 0)}, rcode: dns.RcodeFormatError},
+		{name: "RDATA with class NONE", prerequisites: []dns.RR{withClass(www, dns.ClassNONE, 0)}, rcode: dns.RcodeFormatError},
+		{name: "unknown class", prerequisites: []dns.RR{withClass(www, dns.ClassCHAOS, 0)}, rcode: dns.RcodeFormatError},
+		{name: "out of zone", prerequisites: []dns.RR{header("www.example.org.", dns.TypeANY, dns.ClassANY, 0)}, rcode: dns.RcodeNotZone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prerequisites []dns.RR
+			if len(tt.prerequisites) > 0 {
+				prerequisites = unpacked(t, tt.prerequisites...)
+			}
+
+			if rcode := server.checkPrerequisites(zone, prerequisites); rcode != tt.rcode {
+				t.Errorf("got %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestPrescan(t *testing.T) {
+	useConfig(t, updatedZone)
+	zone := newTestServer(t).zoneFor(testOrigin)
+
+	add := mustRR(t, "new.example.test. 300 IN A 192.0.2.20")
+
+	tests := []struct {
+		name   string
+		update dns.RR
+		rcode  int
+	}{
+		{name: "add", update: add, rcode: dns.RcodeSuccess},
+		{name: "add out of zone", update: mustRR(t, "new.example.org. 300 IN A 192.0.2.20"), rcode: dns.RcodeNotZone},
+		{name: "add without RDATA", update: header("new.example.test.", dns.TypeA, dns.ClassINET, 300), rcode: dns.RcodeFormatError},
+		{name: "add type ANY", update: header("new.example.test.", dns.TypeANY, dns.ClassINET, 300), rcode: dns.RcodeFormatError},
+		{name: "add meta type", update: header("new.example.test.", dns.TypeAXFR, dns.ClassINET, 300), rcode: dns.RcodeFormatError},
+		{name: "delete RRset", update: header("www.example.test.", dns.TypeA, dns.ClassANY, 0), rcode: dns.RcodeSuccess},
+		{name: "delete name", update: header("www.example.test.", dns.TypeANY, dns.ClassANY, 0), rcode: dns.RcodeSuccess},
+		{name: "delete RRset with TTL", update: header("www.example.test.", dns.TypeA, dns.ClassANY, 300), rcode: dns.RcodeFormatError},
+		{name: "delete RRset with RDATA", update: withClass(add, dns.ClassANY, 0), rcode: dns.RcodeFormatError},
+		{name: "delete record", update: withClass(add, dns.ClassNONE, 0), rcode: dns.RcodeSuccess},
+		{name: "delete record with TTL", update: withClass(add, dns.ClassNONE, 300), rcode: dns.RcodeFormatError},
+		{name: "delete record of type ANY", update: header("www.example.test.", dns.TypeANY, dns.ClassNONE, 0), rcode: dns.RcodeFormatError},
+		{name: "unknown class", update: withClass(add, dns.ClassCHAOS, 300), rcode: dns.RcodeFormatError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := unpacked(t, tt.update)[0]
+			if rcode := prescan(zone, update); rcode != tt.rcode {
+				t.Errorf("got %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+// failingStore fails a single append once the allowed appends are used up
+type failingStore struct {
+	store.Store
+	appends int
+}
+
+func (s *failingStore) Append(rr dns.RR) error {
+	s.appends--
+	if s.appends == -1 {
+		return errors.New("storage failure")
+	}
+
+	return s.Store.Append(rr)
+}
+
+func TestRollback(t *testing.T) {
+	useConfig(t, updatedZone)
+	server := newTestServer(t)
+
+	existing := mustRR(t, "old.example.test. 300 IN TXT \"old\"")
+	bolt, err := store.NewBoltStore(filepath.Join(t.TempDir(), "cdns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := Store
+	t.Cleanup(func() {
+		Store = previous
+		_ = bolt.Close()
+	})
+
+	Store = bolt
+	if err = server.appendRecord(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	Store = &failingStore{Store: bolt, appends: 1}
+	updates := unpacked(t,
+		withClass(existing, dns.ClassNONE, 0),
+		mustRR(t, "new.example.test. 300 IN TXT \"new\""),
+		mustRR(t, "failed.example.test. 300 IN TXT \"failed\""),
+	)
+
+	steps, err := server.applyUpdates(updates)
+	if err == nil {
+		t.Fatal("update applied despite the storage failure")
+	}
+
+	if len(steps) != 2 {
+		t.Fatalf("got %d changes before the failure, want 2", len(steps))
+	}
+
+	if err = server.rollback(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := bolt.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || !dns.IsDuplicate(stored[0], existing) {
+		t.Errorf("stored records after rollback are %v, want %v", stored, existing)
+	}
+
+	if records := server.Domains["old.example.test."].Records; !containsRR(records, existing) {
+		t.Error("deleted record was not restored")
+	}
+
+	for _, name := range []string{"new.example.test.", "failed.example.test."} {
+		if records := server.Domains[name].Records; len(records) > 0 {
+			t.Errorf("records %v of %s remain after rollback", records, name)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package dns
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Zone is a zone the server is authoritative for
+type Zone struct {
+	Origin string
+	SOA    dns.RR
+	// Ingress are the addresses of every name in the zone that does not exist, nil unless the wildcard ingress is enabled
+	Ingress []net.IP
+	Records []dns.RR
+	// Keys sign the zone online, nil unless DNSSEC is enabled
+	Keys []*Key
+	// Changes are the dynamic changes since the zone was loaded, oldest first
+	Changes []*Change
+}
+
+// LoadZones builds the default zone from the global SOA, NS and ingress settings and every configured zone of global
+func LoadZones(global *config.Config) ([]*Zone, error) {
+	confs := make([]config.Zone, 0, len(global.DNS.Zones)+1)
+	if global.SOA.Domain != "" {
+		confs = append(confs, config.Zone{
+			NS:          global.NS,
+			SOA:         global.SOA.Timers,
+			Admin:       global.DNS.Admin,
+			NSName:      global.DNS.NSName,
+			Origin:      global.SOA.Domain,
+			Ingress:     global.Ingress,
+			NameServers: global.DNS.NameServers,
+		})
+	}
+	confs = append(confs, global.DNS.Zones...)
+
+	zones := make([]*Zone, 0, len(confs))
+	origins := make(map[string]bool, len(confs))
+	for _, conf := range confs {
+		var err error
+		var zone *Zone
+		if conf.File != "" {
+			zone, err = loadZoneFile(conf)
+		} else {
+			zone, err = newZone(conf, global.SOA.Timers)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to load zone %s%s: %w", conf.Origin, conf.File, err)
+		}
+
+		if origins[zone.Origin] {
+			return nil, fmt.Errorf("zone %s is configured more than once", zone.Origin)
+		}
+		origins[zone.Origin] = true
+
+		if conf.Ingress.Wildcard {
+			for _, address := range addresses(conf.Ingress.IP, conf.Ingress.Addresses) {
+				ip := net.ParseIP(address)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid ingress address %q of zone %s", address, zone.Origin)
+				}
+				zone.Ingress = append(zone.Ingress, ip)
+			}
+		}
+		records, err := parseRecords(conf.Records)
+		if err != nil {
+			return nil, fmt.Errorf("invalid records of zone %s: %w", zone.Origin, err)
+		}
+
+		for _, rr := range records {
+			if !dns.IsSubDomain(zone.Origin, rr.Header().Name) {
+				return nil, fmt.Errorf("record %s is out of zone %s", rr.Header().Name, zone.Origin)
+			}
+		}
+		zone.Records = append(zone.Records, records...)
+
+		if global.DNS.DNSSEC.Enabled {
+			if err := signZone(zone, global); err != nil {
+				return nil, fmt.Errorf("unable to load DNSSEC keys of zone %s: %w", zone.Origin, err)
+			}
+		}
+
+		zones = append(zones, zone)
+	}
+
+	return zones, nil
+}
+
+// newZone builds the SOA, apex NS RRset and name server glue of a zone from its configuration
+func newZone(conf config.Zone, defaults config.Timers) (*Zone, error) {
+	if conf.Origin == "" || (len(conf.NameServers) == 0 && conf.NSName == "") || conf.Admin == "" {
+		return nil, fmt.Errorf("origin, nameservers or nsname and admin are required for zones without a file")
+	}
+
+	origin := strings.ToLower(dns.Fqdn(conf.Origin))
+
+	// The single NS name and IP settings predate name server sets, their glue is only served inside the zone
+	nameservers := conf.NameServers
+	if len(nameservers) == 0 {
+		nameservers = []config.NameServer{{Name: conf.NSName}}
+		if dns.IsSubDomain(origin, strings.ToLower(dns.Fqdn(conf.NSName))) {
+			nameservers[0].Addresses = addresses(conf.NS.IP, conf.NS.Addresses)
+		}
+	}
+	timers := soaTimers(conf.SOA, defaults)
+
+	zone := &Zone{Origin: origin}
+	zone.SOA = &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   origin,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    timers.TTL,
+		},
+		Ns:      strings.ToLower(dns.Fqdn(nameservers[0].Name)),
+		Mbox:    strings.ToLower(dns.Fqdn(conf.Admin)),
+		Serial:  baseSerial(time.Now()),
+		Refresh: timers.Refresh,
+		Retry:   timers.Retry,
+		Expire:  timers.Expire,
+		Minttl:  timers.Minimum,
+	}
+	zone.Records = append(zone.Records, zone.SOA)
+
+	for _, nameserver := range nameservers {
+		name := strings.ToLower(dns.Fqdn(nameserver.Name))
+		zone.Records = append(zone.Records, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   origin,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    timers.TTL,
+			},
+			Ns: name,
+		})
+
+		// Addresses of name servers outside the zone belong to the zone of their name
+		if len(nameserver.Addresses) > 0 && !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("name server %s is out of zone %s, its addresses cannot be served as glue", name, origin)
+		}
+
+		for _, address := range nameserver.Addresses {
+			rr, err := addressRecord(name, address, timers.TTL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address of name server %s: %w", name, err)
+			}
+
+			zone.Records = append(zone.Records, rr)
+		}
+	}
+
+	return zone, nil
+}
+
+// soaTimers fills the zero timers of a zone from the global SOA settings and then from the defaults
+func soaTimers(timers, global config.Timers) config.Timers {
+	defaults := []config.Timers{global, {TTL: defaultTTL, Refresh: 28800, Retry: 7200, Expire: 604800, Minimum: 86400}}
+	for _, fallback := range defaults {
+		timers.TTL = cmp.Or(timers.TTL, fallback.TTL)
+		timers.Retry = cmp.Or(timers.Retry, fallback.Retry)
+		timers.Expire = cmp.Or(timers.Expire, fallback.Expire)
+		timers.Refresh = cmp.Or(timers.Refresh, fallback.Refresh)
+		timers.Minimum = cmp.Or(timers.Minimum, fallback.Minimum)
+	}
+
+	return timers
+}
+
+// addresses joins the single address setting with the address list
+func addresses(ip string, more []string) []string {
+	if ip == "" {
+		return more
+	}
+
+	return append([]string{ip}, more...)
+}
+
+// ingressRecords returns the A or AAAA records of name for the ingress addresses of the family
+func (z *Zone) ingressRecords(name string, qtype uint16) []dns.RR {
+	var records []dns.RR
+	for _, ip := range z.Ingress {
+		if (ip.To4() != nil) != (qtype == dns.TypeA) {
+			continue
+		}
+
+		if rr, err := addressRecord(name, ip.String(), defaultTTL); err == nil {
+			records = append(records, rr)
+		}
+	}
+
+	return records
+}
+
+// addressRecord returns the A or AAAA record of name depending on the address family
+func addressRecord(name, address string, ttl uint32) (dns.RR, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", address)
+	}
+
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip4}, nil
+	}
+
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+}
+
+// loadZoneFile parses a master file with its $ORIGIN, $TTL and $INCLUDE directives
+func loadZoneFile(conf config.Zone) (*Zone, error) {
+	file, err := os.Open(conf.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	origin := ""
+	if conf.Origin != "" {
+		origin = dns.Fqdn(conf.Origin)
+	}
+
+	zone := &Zone{Origin: strings.ToLower(origin)}
+	parser := dns.NewZoneParser(file, origin, conf.File)
+	parser.SetIncludeAllowed(true)
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if zone.SOA != nil {
+				return nil, fmt.Errorf("multiple SOA records in zone")
+			}
+
+			if zone.Origin != "" && soa.Hdr.Name != zone.Origin {
+				return nil, fmt.Errorf("SOA owner %s does not match origin %s", soa.Hdr.Name, zone.Origin)
+			}
+
+			zone.SOA = rr
+			zone.Origin = soa.Hdr.Name
+		}
+
+		zone.Records = append(zone.Records, rr)
+	}
+
+	if err = parser.Err(); err != nil {
+		return nil, err
+	}
+
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("missing SOA record")
+	}
+
+	for _, rr := range zone.Records {
+		if !dns.IsSubDomain(zone.Origin, rr.Header().Name) {
+			return nil, fmt.Errorf("record %s is out of zone %s", rr.Header().Name, zone.Origin)
+		}
+	}
+
+	return zone, nil
+}
+
+// zoneFor returns the most specific loaded zone containing name
+func (d *Server) zoneFor(name string) *Zone {
+	var match *Zone
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, zone := range d.Zones {
+		if dns.IsSubDomain(zone.Origin, name) && (match == nil || len(zone.Origin) > len(match.Origin)) {
+			match = zone
+		}
+	}
+
+	return match
+}
+
+// parentZone returns the zone holding the cut of a nested zone, nil for a zone without a parent among ours
+func (d *Server) parentZone(zone *Zone) *Zone {
+	parent, end := dns.NextLabel(zone.Origin, 0)
+	if end {
+		return nil
+	}
+
+	return d.zoneFor(zone.Origin[parent:])
+}
+
+// zoneForType returns the zone answering for the type at name. The DS RRset at the origin of a
+// nested zone belongs to the parent side of the cut (RFC 4035 section 3.1.4.1).
+func (d *Server) zoneForType(name string, rrtype uint16) *Zone {
+	zone := d.zoneFor(name)
+	if rrtype != dns.TypeDS || zone == nil || zone.Origin != strings.ToLower(dns.Fqdn(name)) {
+		return zone
+	}
+
+	if parent := d.parentZone(zone); parent != nil {
+		return parent
+	}
+
+	return zone
+}
+
+// delegation returns the NS RRset, glue and DS RRset the parent publishes for a nested zone
+func (d *Server) delegation(child *Zone, now time.Time) []dns.RR {
+	var records, nameservers []dns.RR
+	for _, rr := range d.Domains[child.Origin].Records {
+		if rr.Header().Rrtype == dns.TypeNS {
+			nameservers = append(nameservers, rr)
+		}
+	}
+	records = append(records, nameservers...)
+
+	for _, rr := range d.glue(nameservers) {
+		if dns.IsSubDomain(child.Origin, rr.Header().Name) {
+			records = append(records, rr)
+		}
+	}
+
+	for _, ds := range child.DS(dns.SHA256, now) {
+		records = append(records, ds)
+	}
+
+	return records
+}
+
+// soaFor returns the SOA of the zone containing name
+func (d *Server) soaFor(name string) dns.RR {
+	if zone := d.zoneFor(name); zone != nil {
+		return zone.SOA
+	}
+
+	return d.SOA
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/betterde/cdns/internal/journal"
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	recordsBucket  = []byte("records")
+	serialsBucket  = []byte("serials")
+	accountsBucket = []byte("accounts")
+)
+
+// BoltStore persists records in an embedded BoltDB file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("storage path is required for the bolt driver")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordsBucket, serialsBucket, accountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// storedRecord is the value of a record, the creation time keeps the order in which records were added
+type storedRecord struct {
+	RR      string `json:"rr"`
+	Created int64  `json:"created"`
+}
+
+// Records parses every persisted record from its presentation format, in the order they were added
+func (b *BoltStore) Records() ([]dns.RR, error) {
+	stored := make([]storedRecord, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(k, v []byte) error {
+			record := storedRecord{}
+			if err := json.Unmarshal(v, &record); err != nil {
+				// Records stored before the creation time was kept are plain presentation format
+				record = storedRecord{RR: string(v)}
+			}
+
+			stored = append(stored, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(stored, func(i, j int) bool {
+		return stored[i].Created < stored[j].Created
+	})
+
+	records := make([]dns.RR, 0, len(stored))
+	for _, record := range stored {
+		// A record that cannot be parsed must not keep the server from starting
+		rr, err := dns.NewRR(record.RR)
+		if err != nil || rr == nil {
+			journal.Logger.Sugar().With("Record", record.RR, "Error", fmt.Sprint(err)).Warn("Skipping stored record that cannot be parsed")
+			continue
+		}
+
+		records = append(records, rr)
+	}
+
+	return records, nil
+}
+
+func (b *BoltStore) Append(rr dns.RR) error {
+	value, err := json.Marshal(storedRecord{RR: rr.String(), Created: time.Now().UnixNano()})
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Put(recordKey(rr), value)
+	})
+}
+
+func (b *BoltStore) Remove(rr dns.RR) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Delete(recordKey(rr))
+	})
+}
+
+func (b *BoltStore) Account(username string) (*Account, error) {
+	var account *Account
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(accountsBucket).Get([]byte(username))
+		if value == nil {
+			return nil
+		}
+
+		account = &Account{}
+		return json.Unmarshal(value, account)
+	})
+
+	return account, err
+}
+
+func (b *BoltStore) SaveAccount(account Account) error {
+	value, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).Put([]byte(account.Username), value)
+	})
+}
+
+func (b *BoltStore) Serial(zone string) (uint32, error) {
+	var serial uint32
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(serialsBucket).Get([]byte(zone))
+		if len(value) == 4 {
+			serial = binary.BigEndian.Uint32(value)
+		}
+		return nil
+	})
+
+	return serial, err
+}
+
+func (b *BoltStore) SaveSerial(zone string, serial uint32) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(serialsBucket).Put([]byte(zone), binary.BigEndian.AppendUint32(nil, serial))
+	})
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// recordKey identifies a record by its owner name, type and data, so the same record is only stored once
+func recordKey(rr dns.RR) []byte {
+	hdr := rr.Header()
+	return []byte(fmt.Sprintf("%s %s %s", strings.ToLower(hdr.Name), dns.TypeToString[hdr.Rrtype], strings.TrimPrefix(rr.String(), hdr.String())))
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+)
+
+// MemoryStore keeps no records, they only live in the DNS servers and are lost on restart.
+// Accounts and serials are kept in memory so that acme-dns clients keep working until the next restart,
+// the DNS server keeps the serials in a SerialFile instead so that they never go backwards.
+type MemoryStore struct {
+	serials  map[string]uint32
+	accounts map[string]Account
+	sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{serials: make(map[string]uint32), accounts: make(map[string]Account)}
+}
+
+func (m *MemoryStore) Records() ([]dns.RR, error) {
+	return nil, nil
+}
+
+func (m *MemoryStore) Append(rr dns.RR) error {
+	return nil
+}
+
+func (m *MemoryStore) Remove(rr dns.RR) error {
+	return nil
+}
+
+func (m *MemoryStore) Account(username string) (*Account, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	account, ok := m.accounts[username]
+	if !ok {
+		return nil, nil
+	}
+
+	return &account, nil
+}
+
+func (m *MemoryStore) SaveAccount(account Account) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.accounts[account.Username] = account
+	return nil
+}
+
+func (m *MemoryStore) Serial(zone string) (uint32, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.serials[zone], nil
+}
+
+func (m *MemoryStore) SaveSerial(zone string, serial uint32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.serials[zone] = serial
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SerialStore persists the last SOA serial of every zone
+type SerialStore interface {
+	// Serial returns the last SOA serial of a zone, or 0 if none was saved
+	Serial(zone string) (uint32, error)
+	// SaveSerial persists the last SOA serial of a zone
+	SaveSerial(zone string, serial uint32) error
+}
+
+// SerialFile keeps the SOA serials in a JSON state file, for the stores that do not persist them
+type SerialFile struct {
+	path    string
+	serials map[string]uint32
+	sync.Mutex
+}
+
+// NewSerialFile reads the serials saved in the file, which is created on the first save
+func NewSerialFile(path string) (*SerialFile, error) {
+	f := &SerialFile{path: path, serials: make(map[string]uint32)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, json.Unmarshal(data, &f.serials)
+}
+
+func (f *SerialFile) Serial(zone string) (uint32, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.serials[zone], nil
+}
+
+// SaveSerial writes all serials to a temporary file that replaces the state file, so a crash never leaves it truncated
+func (f *SerialFile) SaveSerial(zone string, serial uint32) error {
+	f.Lock()
+	defer f.Unlock()
+
+	serials := make(map[string]uint32, len(f.serials)+1)
+	for name, value := range f.serials {
+		serials[name] = value
+	}
+	serials[zone] = serial
+
+	data, err := json.MarshalIndent(serials, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+
+	temp := f.path + ".tmp"
+	if err = os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+
+	if err = os.Rename(temp, f.path); err != nil {
+		return err
+	}
+
+	f.serials = serials
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"fmt"
+	"github.com/betterde/cdns/config"
+	"github.com/miekg/dns"
+)
+
+// Store persists the dynamic records created through the HTTP API and the SOA serials of the zones
+type Store interface {
+	// Records returns all persisted records
+	Records() ([]dns.RR, error)
+	// Append persists a new record
+	Append(rr dns.RR) error
+	// Remove deletes a persisted record
+	Remove(rr dns.RR) error
+	// Account returns the acme-dns account of username, or nil if it does not exist
+	Account(username string) (*Account, error)
+	// SaveAccount persists an acme-dns account
+	SaveAccount(account Account) error
+	SerialStore
+	// Close releases the underlying resources
+	Close() error
+}
+
+// Account is an acme-dns compatible account allowed to update the TXT records of its subdomain
+type Account struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom"`
+}
+
+// New creates a store for the configured driver
+func New(conf config.Storage) (Store, error) {
+	switch conf.Driver {
+	case "", config.StorageDriverMemory:
+		return NewMemoryStore(), nil
+	case config.StorageDriverBolt:
+		return NewBoltStore(conf.Path)
+	default:
+		return nil, fmt.Errorf("unsupported storage driver %s", conf.Driver)
+	}
+}